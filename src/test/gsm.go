@@ -5,13 +5,14 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/stianeikeland/go-rpio"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -22,11 +23,34 @@ import (
 
 var config utils.Config
 
+const (
+	SMS_REPLY_SIZE  int = 70
+	SMS_REPLY_PARTS int = 3
+	PHONEBOOK_PAGE  int = 20
+
+	SIM_QUERY_TIMEOUT time.Duration = time.Duration(30) * time.Second
+)
+
 var wxAccessToken utils.WXAccessToken
 var baiDuAccessToken utils.BaiDuAccessToken
+var recognizer utils.SpeechRecognizer
+var audioPipeline *utils.AudioPipeline
+var intents *utils.IntentMatcher
+
+var modems []*utils.Modem
 
-var taskbus = make(chan utils.PhoneMsg, 100)
-var resultbus = make(chan utils.PhoneMsg, 100)
+var registry = utils.NewCmdRegistry()
+var jobRunner *utils.JobRunner
+var confirmer *utils.Confirmer
+var cmdFile *utils.CmdFile
+var scheduler *utils.Scheduler
+var otpStore *utils.OTPStore
+var smsRules *utils.SMSRules
+var smsControl *utils.SMSControl
+var fan *utils.FanController
+var sensors *utils.SensorHub
+
+var ussdRgx = regexp.MustCompile(`^[0-9*#]{1,32}$`)
 
 func getStrUnicode(s string) string {
 	result := fmt.Sprintf("%U", []rune(s))
@@ -37,133 +61,777 @@ func getStrUnicode(s string) string {
 	return result
 }
 
-func executeCmd(cmd string, cmdDict map[string]string, taskbus chan utils.PhoneMsg) {
-	var flag string
-	var exec_result string
-	phone_num_match := `^(\+)?\d+`
-	phone_num_rgx := regexp.MustCompile(phone_num_match)
-	if _, ok := cmdDict[cmd]; ok {
-		if strings.HasPrefix(cmdDict[cmd], "http://") || strings.HasPrefix(cmdDict[cmd], "https://") {
-			flag = "http"
+func registerCommands() {
+	registry.Register(&utils.Command{
+		Name:    "help",
+		Aliases: []string{"帮助", "指令", "?", "？"},
+		Help:    "列出所有可用指令",
+		Role:    utils.ROLE_VIEWER,
+		Handler: cmdHelp,
+	})
+	registry.Register(&utils.Command{
+		Name:    "cmd",
+		Aliases: []string{"命令", "执行"},
+		Args:    []utils.CmdArg{{Name: "命令行", Kind: utils.ARG_TEXT}},
+		Help:    "在树莓派上执行scripts中允许的命令, 支持引号",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdShell,
+	})
+	registry.Register(&utils.Command{
+		Name:    "ps",
+		Aliases: []string{"任务", "进程"},
+		Help:    "列出正在执行和最近结束的命令",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdPs,
+	})
+	registry.Register(&utils.Command{
+		Name:    "kill",
+		Aliases: []string{"结束", "停止"},
+		Args:    []utils.CmdArg{{Name: "编号", Kind: utils.ARG_INT}},
+		Help:    "结束正在执行的命令",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdKill,
+	})
+	registry.Register(&utils.Command{
+		Name:    "more",
+		Aliases: []string{"更多", "翻页"},
+		Args:    []utils.CmdArg{{Name: "编号", Kind: utils.ARG_INT}, {Name: "页码", Kind: utils.ARG_INT, Optional: true}},
+		Help:    "查看命令输出的其他页",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdMore,
+	})
+	registry.Register(&utils.Command{
+		Name:    "dial",
+		Aliases: []string{"拨号", "打电话", "呼叫"},
+		Args:    []utils.CmdArg{{Name: "号码", Kind: utils.ARG_WORD}},
+		Help:    "拨打电话, dial::ath 挂断",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdDial,
+	})
+	registry.Register(&utils.Command{
+		Name:    "say",
+		Aliases: []string{"播报", "语音通知"},
+		Args:    []utils.CmdArg{{Name: "号码", Kind: utils.ARG_PHONE}, {Name: "内容", Kind: utils.ARG_TEXT}},
+		Help:    "拨打电话, 对方接听后播放内容并报告接听、占线或无人接听",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdSay,
+	})
+	registry.Register(&utils.Command{
+		Name:    "hangup",
+		Aliases: []string{"ath", "挂机", "挂断"},
+		Help:    "挂断电话",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdHangup,
+	})
+	registry.Register(&utils.Command{
+		Name:    "sms",
+		Aliases: []string{"短信", "发短信"},
+		Args:    []utils.CmdArg{{Name: "号码", Kind: utils.ARG_PHONE}, {Name: "内容", Kind: utils.ARG_TEXT}},
+		Help:    "发送短信",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdSMS,
+	})
+	registry.Register(&utils.Command{
+		Name:    "at",
+		Aliases: []string{"定时"},
+		Args:    []utils.CmdArg{{Name: "时间", Kind: utils.ARG_TEXT}, {Name: "指令", Kind: utils.ARG_TEXT}},
+		Help:    "在指定时间执行一次指令, 如 at::08:00::开灯",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdAt,
+	})
+	registry.Register(&utils.Command{
+		Name:    "every",
+		Aliases: []string{"每隔"},
+		Args:    []utils.CmdArg{{Name: "间隔", Kind: utils.ARG_WORD}, {Name: "指令", Kind: utils.ARG_TEXT}},
+		Help:    "每隔一段时间执行指令, 如 every::1h::温度",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdEvery,
+	})
+	registry.Register(&utils.Command{
+		Name:    "jobs",
+		Aliases: []string{"定时任务"},
+		Help:    "列出定时任务",
+		Role:    utils.ROLE_VIEWER,
+		Handler: cmdJobs,
+	})
+	registry.Register(&utils.Command{
+		Name:    "cancel",
+		Aliases: []string{"取消"},
+		Args:    []utils.CmdArg{{Name: "编号", Kind: utils.ARG_INT}},
+		Help:    "取消定时任务",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdCancel,
+	})
+	registry.Register(&utils.Command{
+		Name:    "otp",
+		Aliases: []string{"验证码"},
+		Args:    []utils.CmdArg{{Name: "服务", Kind: utils.ARG_TEXT, Optional: true}},
+		Help:    "列出最近收到且未过期的验证码",
+		Role:    utils.ROLE_VIEWER,
+		Handler: cmdOTP,
+	})
+	registry.Register(&utils.Command{
+		Name:    "away",
+		Aliases: []string{"离开", "勿扰"},
+		Args:    []utils.CmdArg{{Name: "开关", Kind: utils.ARG_WORD, Optional: true}},
+		Help:    "开启(on)或关闭(off)离开模式, 离开模式下smsrules中away的规则才会生效",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdAway,
+	})
+	registry.Register(&utils.Command{
+		Name:    "ussd",
+		Aliases: []string{"余额", "查询"},
+		Args:    []utils.CmdArg{{Name: "代码", Kind: utils.ARG_WORD}},
+		Help:    "发送USSD查询(如*100#), 菜单会话中发送选项继续, cancel结束会话",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdUSSD,
+	})
+	registry.Register(&utils.Command{
+		Name:    "status",
+		Aliases: []string{"状态", "信号"},
+		Help:    "查看信号强度、SIM卡、运营商和网络注册状态",
+		Role:    utils.ROLE_VIEWER,
+		Handler: cmdStatus,
+	})
+	registry.Register(&utils.Command{
+		Name:    "sim",
+		Aliases: []string{"SIM卡", "本机号码"},
+		Help:    "查看SIM卡的ICCID、IMSI、本机号码和PIN剩余次数",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdSIM,
+	})
+	registry.Register(&utils.Command{
+		Name:    "pin",
+		Aliases: []string{"解锁"},
+		Args:    []utils.CmdArg{{Name: "PIN", Kind: utils.ARG_WORD, Secret: true}},
+		Help:    "输入PIN解锁SIM卡",
+		Role:    utils.ROLE_ADMIN,
+		Handler: cmdPIN,
+	})
+	registry.Register(&utils.Command{
+		Name:    "changepin",
+		Aliases: []string{"修改PIN"},
+		Args:    []utils.CmdArg{{Name: "旧PIN", Kind: utils.ARG_WORD, Secret: true}, {Name: "新PIN", Kind: utils.ARG_WORD, Secret: true}},
+		Help:    "修改SIM卡的PIN, 需要同时修改simpin或simpinfile",
+		Role:    utils.ROLE_ADMIN,
+		Handler: cmdChangePIN,
+	})
+	registry.Register(&utils.Command{
+		Name:    "phonebook",
+		Aliases: []string{"通讯录"},
+		Args:    []utils.CmdArg{{Name: "起始", Kind: utils.ARG_INT, Optional: true}},
+		Help:    "读取SIM卡通讯录, 每次20条",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdPhonebook,
+	})
+	registry.Register(&utils.Command{
+		Name:    "fan",
+		Aliases: []string{"风扇"},
+		Args:    []utils.CmdArg{{Name: "占空比", Kind: utils.ARG_WORD, Optional: true}},
+		Help:    "查看温度和风扇状态, auto 按温度控制, on/off 或 0-100 手动设置转速",
+		Role:    utils.ROLE_OPERATOR,
+		Handler: cmdFan,
+	})
+	registry.Register(&utils.Command{
+		Name:    "sensor",
+		Aliases: []string{"传感器", "环境"},
+		Args:    []utils.CmdArg{{Name: "参数", Kind: utils.ARG_TEXT, Optional: true}},
+		Help:    "查看传感器的最新读数, 指定名称时统计一段时间(默认24h)内的最低、最高和平均值, 如 sensor::humi 24h",
+		Role:    utils.ROLE_VIEWER,
+		Handler: cmdSensor,
+	})
+}
+
+func cmdHelp(req utils.CmdRequest, args utils.CmdArgs) string {
+	role := utils.RoleOf(config, req.User)
+	result := "可用指令(参数以::分隔):\n" + registry.Help(role)
+	if ext := cmdFile.Help(); len(ext) > 0 && role >= cmdFileRole(nil) {
+		result += "\n扩展指令:\n" + ext
+	}
+	return result
+}
+
+func cmdShell(req utils.CmdRequest, args utils.CmdArgs) string {
+	fields, err := utils.SplitArgs(args["命令行"])
+	if err != nil {
+		return err.Error()
+	}
+	script, cmdargs, err := jobRunner.Resolve(fields)
+	if err != nil {
+		return err.Error()
+	}
+	need := utils.ROLE_ADMIN
+	if len(script.Role) > 0 {
+		need = utils.ParseRole(script.Role)
+	}
+	if utils.RoleOf(config, req.User) < need {
+		return denyCmd(req, "cmd::"+fields[0])
+	}
+	job, err := jobRunner.Start(req.User, fields[0], script, cmdargs, func(info utils.JobInfo, output string) {
+		replyTo(req, jobResult(info, output, 1))
+	})
+	if err != nil {
+		return err.Error()
+	}
+	log.Printf("%s start job #%d: %s %v", req.User, job.ID, script.Path, cmdargs)
+	return ""
+}
+
+func jobResult(info utils.JobInfo, output string, page int) string {
+	var result string
+	switch {
+	case info.Running:
+		result = fmt.Sprintf("任务 #%d %s 正在执行", info.ID, info.Name)
+	case info.Killed:
+		result = fmt.Sprintf("任务 #%d %s 已被结束", info.ID, info.Name)
+	case info.Err != nil:
+		result = fmt.Sprintf("任务 #%d %s 执行失败: %v", info.ID, info.Name, info.Err)
+	default:
+		result = fmt.Sprintf("任务 #%d %s 执行成功.", info.ID, info.Name)
+	}
+	if info.Truncated {
+		result += " (输出过长已截断)"
+	}
+	if len(output) == 0 {
+		return result
+	}
+	size := config.PageSize
+	if size <= 0 {
+		size = utils.DEFAULT_PAGE_SIZE
+	}
+	//留出任务状态和翻页提示的位置, pagesize较小时至少保留一半给输出
+	body := size - 200
+	if body < size/2 {
+		body = size/2 + 1
+	}
+	pages := utils.Paginate(output, body)
+	if page < 1 || page > len(pages) {
+		return fmt.Sprintf("%s\n页码有误, 共%d页", result, len(pages))
+	}
+	result += "\n" + pages[page-1]
+	if len(pages) > 1 {
+		result += fmt.Sprintf("\n(第%d/%d页, 发送 more::%d::页码 查看其他页)", page, len(pages), info.ID)
+	}
+	return result
+}
+
+func cmdPs(req utils.CmdRequest, args utils.CmdArgs) string {
+	jobs := jobRunner.List()
+	if len(jobs) == 0 {
+		return "没有正在执行或最近结束的命令"
+	}
+	var lines []string
+	for _, job := range jobs {
+		state := "执行中"
+		if job.Killed {
+			state = "已结束"
+		} else if !job.Running && job.Err != nil {
+			state = "失败"
+		} else if !job.Running {
+			state = "完成"
 		}
+		lines = append(lines, fmt.Sprintf("#%d %s %s %s %s", job.ID, job.Name, state, job.User, job.Started.Format("01-02 15:04:05")))
 	}
+	return strings.Join(lines, "\n")
+}
 
-	if strings.HasPrefix(cmd, "cmd::") {
-		flag = "cmd"
+func cmdKill(req utils.CmdRequest, args utils.CmdArgs) string {
+	info, _, ok := jobRunner.Get(args.Int("编号"))
+	if ok && info.User != req.User && utils.RoleOf(config, req.User) < utils.ROLE_ADMIN {
+		return denyCmd(req, "kill")
+	}
+	if err := jobRunner.Kill(args.Int("编号")); err != nil {
+		return err.Error()
 	}
-	if strings.HasPrefix(cmd, "dial::") {
-		flag = "dial"
+	return ""
+}
+
+func cmdMore(req utils.CmdRequest, args utils.CmdArgs) string {
+	info, output, ok := jobRunner.Get(args.Int("编号"))
+	if !ok {
+		return fmt.Sprintf("任务 #%d 不存在", args.Int("编号"))
 	}
-	if strings.HasPrefix(cmd, "sms::") {
-		flag = "sms"
+	page := 1
+	if len(args["页码"]) > 0 {
+		page = args.Int("页码")
 	}
+	return jobResult(info, output, page)
+}
 
-	switch flag {
-	case "http":
-		resp, err := http.Get(cmdDict[cmd])
-		if err != nil {
-			exec_result = err.Error()
-			break
+// 指令中用@指定了模块时使用该模块, 否则使用第一个模块; 模块名已经在executeCmd中校验过
+func modemOf(req utils.CmdRequest) *utils.Modem {
+	if m, err := utils.FindModem(modems, req.Modem); err == nil {
+		return m
+	}
+	return modems[0]
+}
+
+// 没有用@指定模块时按modemroutes选择
+func routeModem(req utils.CmdRequest, phone string) *utils.Modem {
+	if len(req.Modem) > 0 {
+		return modemOf(req)
+	}
+	return utils.RouteModem(modems, config.ModemRoutes, phone)
+}
+
+// 兼容旧的 dial::ath 挂断
+func cmdDial(req utils.CmdRequest, args utils.CmdArgs) string {
+	if strings.EqualFold(args["号码"], "ath") {
+		return cmdHangup(req, args)
+	}
+	if !utils.IsPhoneNumber(args["号码"]) {
+		return "抱歉，手机号码有误: " + args["号码"] + ", 用法: dial::<号码>"
+	}
+	phoneMsg := utils.PhoneMsg{CmdDelay: 1, User: req.User}
+	phoneMsg.ATCmd = []byte(utils.CMD_ATD + args["号码"] + ";" + utils.CMD_LF_CR)
+	routeModem(req, args["号码"]).Urgent <- phoneMsg
+	return ""
+}
+
+// 通话过程较长, 在后台执行并通知进度
+func cmdSay(req utils.CmdRequest, args utils.CmdArgs) string {
+	phone := args["号码"]
+	modem := routeModem(req, phone)
+	go func() {
+		result := utils.SayCall(modem, phone, args["内容"], func(msg string) {
+			replyTo(req, modem.Tag()+msg)
+		})
+		log.Printf("say to %s: %s", phone, result)
+		replyTo(req, modem.Tag()+result)
+	}()
+	return ""
+}
+
+func cmdHangup(req utils.CmdRequest, args utils.CmdArgs) string {
+	phoneMsg := utils.PhoneMsg{CmdDelay: 1}
+	phoneMsg.ATCmd = []byte(utils.CMD_ATH + utils.CMD_LF_CR)
+	modemOf(req).Urgent <- phoneMsg
+	return "已发送挂断指令"
+}
+
+func cmdSMS(req utils.CmdRequest, args utils.CmdArgs) string {
+	sendSMS(routeModem(req, args["号码"]), args["号码"], args["内容"], req.User)
+	return ""
+}
+
+// user为发起的账号, 发送结果和状态报告通知该账号, 为空时通知wxuser
+func sendSMS(modem *utils.Modem, phone string, body string, user string) {
+	phonecode := getStrUnicode(phone)
+	smsbody := getStrUnicode(body)
+
+	//设置文本模式和编码后立即发送, 中间不会插入读短信等指令
+	phoneMsg := utils.PhoneMsg{CmdDelay: 2, Phone: phone, User: user}
+	phoneMsg.Prepare = []string{utils.CMD_CMGF, utils.CMD_CSCS_UCS2, utils.CMD_CSMP}
+	phoneMsg.ATCmd = []byte(utils.CMD_CMGS + phonecode + "\":::" + smsbody + utils.CMD_CTRL_Z)
+	modem.Urgent <- phoneMsg
+}
+
+func cmdAway(req utils.CmdRequest, args utils.CmdArgs) string {
+	switch strings.ToLower(args["开关"]) {
+	case "on", "开", "开启", "1":
+		smsRules.SetAway(true)
+	case "off", "关", "关闭", "0":
+		smsRules.SetAway(false)
+	case "":
+	default:
+		return "参数应为 on 或 off"
+	}
+	if smsRules.Away() {
+		return "离开模式: 开启"
+	}
+	return "离开模式: 关闭"
+}
+
+// USSD的指令字符串按GSM字符集发送, 定时任务发起的查询只在余额不足或失败时通知
+func cmdUSSD(req utils.CmdRequest, args utils.CmdArgs) string {
+	modem := modemOf(req)
+	code := args["代码"]
+	if strings.ToLower(code) == "cancel" {
+		modem.Urgent <- utils.PhoneMsg{CmdDelay: 1, ATCmd: []byte(utils.CMD_CUSD_END + utils.CMD_LF_CR)}
+		return "USSD会话已结束"
+	}
+	if !ussdRgx.MatchString(code) {
+		return "USSD代码只能包含数字、*和#"
+	}
+	phoneMsg := utils.PhoneMsg{CmdDelay: 1, Quiet: req.Source == "cron", User: req.User}
+	phoneMsg.Prepare = []string{utils.CMD_CSCS_GSM}
+	phoneMsg.ATCmd = []byte(utils.CMD_CUSD + code + "\",15" + utils.CMD_LF_CR)
+	phoneMsg.Restore = []string{utils.CMD_CSCS_UCS2}
+	modem.Urgent <- phoneMsg
+	return ""
+}
+
+// 没有用@指定模块时列出所有模块的状态
+func cmdStatus(req utils.CmdRequest, args utils.CmdArgs) string {
+	if len(req.Modem) > 0 {
+		return modemOf(req).Monitor.Status().String()
+	}
+	var result []string
+	for _, m := range modems {
+		status := m.Monitor.Status().String()
+		if len(m.Label) > 0 {
+			status = m.Tag() + m.Number + "\n" + status
 		}
+		result = append(result, status)
+	}
+	return strings.Join(result, "\n\n")
+}
 
-		defer resp.Body.Close()
+// 查询指令的结果由modem解析, 全部执行完后再回复
+func cmdSIM(req utils.CmdRequest, args utils.CmdArgs) string {
+	modem := modemOf(req)
+	go func() {
+		for _, cmd := range []string{utils.CMD_CPIN, utils.CMD_ICCID, utils.CMD_CIMI, utils.CMD_CNUM, utils.CMD_QPINC} {
+			if _, err := modem.Exec(utils.PhoneMsg{CmdDelay: 1, ATCmd: []byte(cmd + utils.CMD_LF_CR)}, SIM_QUERY_TIMEOUT); err != nil {
+				replyTo(req, modem.Tag()+err.Error())
+				return
+			}
+		}
+		replyTo(req, modem.Tag()+modem.Monitor.Status().SIMInfo())
+	}()
+	return ""
+}
 
-		body, _ := ioutil.ReadAll(resp.Body)
-		exec_result = string(body[:])
-	case "cmd":
-		var err error
-		var out []byte
-		tmpcmds := strings.Replace(cmd, "cmd::", "", -1)
-		if strings.Contains(tmpcmds, " ") {
-			tmp2cmds := strings.Split(tmpcmds, " ")
-			out, err = exec.Command(tmp2cmds[0], tmp2cmds[1:]...).Output()
-		} else {
-			out, err = exec.Command(tmpcmds).Output()
+func cmdPIN(req utils.CmdRequest, args utils.CmdArgs) string {
+	if !utils.IsPIN(args["PIN"]) {
+		return "PIN应为4-8位数字"
+	}
+	return sendPIN(req, "输入PIN", utils.CMD_CPIN_SET+args["PIN"]+"\"")
+}
+
+func cmdChangePIN(req utils.CmdRequest, args utils.CmdArgs) string {
+	if !utils.IsPIN(args["旧PIN"]) || !utils.IsPIN(args["新PIN"]) {
+		return "PIN应为4-8位数字"
+	}
+	return sendPIN(req, "修改PIN", utils.CMD_CPWD+args["旧PIN"]+"\",\""+args["新PIN"]+"\"")
+}
+
+// 与自动解锁一样先查询PIN剩余次数, 剩余次数少于MIN_PIN_TRIES时需要回复确认码, 短信指令直接拒绝
+func sendPIN(req utils.CmdRequest, summary string, atcmd string) string {
+	modem := modemOf(req)
+	send := func() string {
+		modem.Urgent <- utils.PhoneMsg{CmdDelay: 1, ATCmd: []byte(atcmd + utils.CMD_LF_CR), User: req.User}
+		return ""
+	}
+	go func() {
+		if _, err := modem.Exec(utils.PhoneMsg{CmdDelay: 1, ATCmd: []byte(utils.CMD_QPINC + utils.CMD_LF_CR)}, SIM_QUERY_TIMEOUT); err != nil {
+			replyTo(req, modem.Tag()+err.Error())
+			return
+		}
+		left := modem.Monitor.Status().PINLeft
+		switch {
+		case left < 0 || left >= utils.MIN_PIN_TRIES:
+			send()
+		case left == 0:
+			replyTo(req, modem.Tag()+"SIM卡PIN剩余次数为0, 需要使用PUK码解锁")
+		case req.Source == "text" || req.Source == "voice":
+			code := confirmer.Add(req, summary, send)
+			replyTo(req, fmt.Sprintf("%sSIM卡PIN剩余次数只有%d次, 输错将锁卡\n确认%s请在%d秒内回复确认码 %s", modem.Tag(), left, summary, int(confirmer.Timeout().Seconds()), code))
+		default:
+			replyTo(req, fmt.Sprintf("%sSIM卡PIN剩余次数只有%d次, 为防止锁卡请通过企业微信执行", modem.Tag(), left))
+		}
+	}()
+	return ""
+}
+
+func cmdPhonebook(req utils.CmdRequest, args utils.CmdArgs) string {
+	start := args.Int("起始")
+	if start <= 0 {
+		start = 1
+	}
+	phoneMsg := utils.PhoneMsg{CmdDelay: 1, User: req.User}
+	phoneMsg.Prepare = []string{utils.CMD_CPBS}
+	phoneMsg.ATCmd = []byte(fmt.Sprintf("%s%d,%d%s", utils.CMD_CPBR, start, start+PHONEBOOK_PAGE-1, utils.CMD_LF_CR))
+	modemOf(req).Urgent <- phoneMsg
+	return ""
+}
+
+// smscontrol中的号码发来的短信作为指令执行, 其他短信按smsrules处理: 自动回复, 执行指令或调用webhook
+func process_sms(inbound chan utils.SMS, command_bus chan utils.CmdRequest) {
+	for {
+		sms := <-inbound
+		if smsControl.Enabled() {
+			user, command, err := smsControl.Check(sms)
+			if err != nil {
+				log.Printf("sms control rejected: %v", err)
+				utils.SendWXMsg("短信指令校验失败: "+err.Error(), config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+				continue
+			}
+			if len(user) > 0 {
+				log.Printf("sms control from %s as %s: %s", sms.Sender, user, registry.Mask(command))
+				command_bus <- utils.CmdRequest{User: user, Text: command, Source: "sms", Phone: sms.Sender, Modem: sms.Modem}
+				continue
+			}
 		}
+		for _, rule := range smsRules.Match(sms) {
+			log.Printf("smsrule %s matched message from %s", rule.Name, sms.Sender)
+			if len(rule.Reply) > 0 {
+				sendSMS(modemOf(utils.CmdRequest{Modem: sms.Modem}), sms.Sender, rule.ReplyText(sms), "")
+			}
+			if len(rule.Action) > 0 {
+				command_bus <- utils.CmdRequest{User: ruleUser(rule), Text: rule.Action, Source: "rule"}
+			}
+			if len(rule.Webhook) > 0 {
+				go func(rule utils.SMSRule, sms utils.SMS) {
+					if err := utils.PostWebhook(rule.Webhook, rule.Name, sms); err != nil {
+						log.Printf("smsrule %s webhook error: %v", rule.Name, err)
+					}
+				}(rule, sms)
+			}
+		}
+	}
+}
+
+// 返回指令名以及执行需要的角色
+func lookupCmd(command string) (string, int, error) {
+	command, _ = utils.SplitModemLabel(command)
+	name, _, _ := strings.Cut(utils.NormalizeCommand(command), utils.CMD_SEP)
+	if def, ok := cmdFile.Lookup(name); ok {
+		return def.Name(), cmdFileRole(def), nil
+	}
+	parsed, err := registry.Parse(command)
+	if err != nil {
+		return "", utils.ROLE_NONE, err
+	}
+	return parsed.Command.Name, parsed.Command.Role, nil
+}
+
+// 定时执行的指令在创建时先检查能否识别以及创建人的权限, 返回指令名
+func checkScheduleCmd(req utils.CmdRequest, command string) (string, error) {
+	name, role, err := lookupCmd(command)
+	if err != nil {
+		return "", err
+	}
+	if utils.RoleOf(config, req.User) < role {
+		return "", errors.New(denyCmd(req, name))
+	}
+	return name, nil
+}
+
+// 短信规则的action执行时没有人确认, 加载时检查规则账号的权限, 需要确认的指令不能作为action
+func checkRuleAction(rule utils.SMSRule) error {
+	name, role, err := lookupCmd(rule.Action)
+	if err != nil {
+		return err
+	}
+	if utils.RoleOf(config, ruleUser(rule)) < role {
+		return fmt.Errorf("账号 %s 没有执行 %s 的权限", ruleUser(rule), name)
+	}
+	if confirmer.Need(name) {
+		return fmt.Errorf("%s 需要确认, 不能由短信规则触发", name)
+	}
+	return nil
+}
+
+// 没有指定user的规则以wxuser中的第一个账号执行
+func ruleUser(rule utils.SMSRule) string {
+	if len(rule.User) > 0 {
+		return rule.User
+	}
+	return strings.Split(config.WxUser, "|")[0]
+}
+
+// 定时任务以cron身份执行时不再确认, 需要确认的指令在创建任务时确认
+func addSchedule(req utils.CmdRequest, job utils.ScheduleJob) string {
+	name, err := checkScheduleCmd(req, job.Command)
+	if err != nil {
+		return err.Error()
+	}
+	add := func() string {
+		job, err := scheduler.Add(job)
 		if err != nil {
-			exec_result = err.Error()
-		} else {
-			if len(out) > 0 {
-				exec_result = string(out)
-			} else {
-				exec_result = tmpcmds + " 执行成功."
+			return err.Error()
+		}
+		return "已添加定时任务 " + job.Describe()
+	}
+	if confirmer.Need(name) && (req.Source == "text" || req.Source == "voice") {
+		summary := "定时任务 " + job.Command
+		code := confirmer.Add(req, summary, add)
+		return fmt.Sprintf("即将添加: %s\n请在%d秒内回复确认码 %s", summary, int(confirmer.Timeout().Seconds()), code)
+	}
+	return add()
+}
+
+func cmdAt(req utils.CmdRequest, args utils.CmdArgs) string {
+	at, err := utils.ParseAt(args["时间"], time.Now())
+	if err != nil {
+		return err.Error()
+	}
+	return addSchedule(req, utils.ScheduleJob{At: at, Command: args["指令"], User: req.User})
+}
+
+func cmdEvery(req utils.CmdRequest, args utils.CmdArgs) string {
+	return addSchedule(req, utils.ScheduleJob{Every: args["间隔"], Command: args["指令"], User: req.User})
+}
+
+func cmdJobs(req utils.CmdRequest, args utils.CmdArgs) string {
+	jobs := scheduler.List(req.User, utils.RoleOf(config, req.User) >= utils.ROLE_ADMIN)
+	if len(jobs) == 0 {
+		return "没有定时任务"
+	}
+	var lines []string
+	for _, job := range jobs {
+		lines = append(lines, job.Describe())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func cmdCancel(req utils.CmdRequest, args utils.CmdArgs) string {
+	err := scheduler.Cancel(args.Int("编号"), req.User, utils.RoleOf(config, req.User) >= utils.ROLE_ADMIN)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("已取消定时任务 #%d", args.Int("编号"))
+}
+
+func cmdOTP(req utils.CmdRequest, args utils.CmdArgs) string {
+	codes := otpStore.List(args["服务"])
+	if len(codes) == 0 {
+		return "没有未过期的验证码"
+	}
+	var lines []string
+	for _, otp := range codes {
+		lines = append(lines, fmt.Sprintf("%s 来源: %s 时间: %s", utils.FormatOTP(&otp), otp.Sender, otp.Received.Format("15:04:05")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func cmdFileRole(def *utils.CmdDef) int {
+	if def != nil && len(def.Role) > 0 {
+		return utils.ParseRole(def.Role)
+	}
+	if len(config.CMDFileRole) > 0 {
+		return utils.ParseRole(config.CMDFileRole)
+	}
+	return utils.ROLE_OPERATOR
+}
+
+// 拒绝越权的指令, 记录日志并通知管理员
+func denyCmd(req utils.CmdRequest, name string) string {
+	log.Printf("deny %s command %s from %s", req.Source, name, req.User)
+	notice := fmt.Sprintf("账号 %s 尝试执行无权限的指令: %s", req.User, registry.Mask(req.Text))
+	utils.SendWXMsg(notice, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+	return "抱歉，您没有执行此指令的权限"
+}
+
+// 指令名可以直接识别时不做意图匹配
+func knownCommand(text string) bool {
+	text, _ = utils.SplitModemLabel(text)
+	name, _, _ := strings.Cut(text, utils.CMD_SEP)
+	_, ok := cmdFile.Lookup(name)
+	return ok || registry.Lookup(name) != nil
+}
+
+func commandNames() map[string]string {
+	names := registry.Names()
+	for k, v := range cmdFile.Names() {
+		names[k] = v
+	}
+	return names
+}
+
+func executeCmd(req utils.CmdRequest) {
+	var exec_result string
+	var run func() string
+	var summary string
+	//语音指令按意图匹配, 有歧义时列出候选项, 用户回复编号后执行
+	//只有微信用户发来的语音和文字才能回复编号, 短信、规则和定时任务不能选择候选项
+	if req.Source == "voice" || req.Source == "text" {
+		if command, ok := intents.Choose(req.User, req.Text); ok {
+			req.Text = command
+		} else if req.Source == "voice" && !knownCommand(req.Text) {
+			match := intents.Match(req.Text, commandNames())
+			if len(match.Command) > 0 {
+				log.Printf("voice intent from %s: %s -> %s", req.User, registry.Mask(req.Text), registry.Mask(match.Command))
+				req.Text = match.Command
+			} else if len(match.Candidates) > 1 {
+				replyTo(req, intents.Ask(req.User, match.Candidates))
+				return
 			}
 		}
-	case "dial":
-		phone_cmd := strings.Replace(cmd, "dial::", "", -1)
-		if phone_num_rgx.MatchString(phone_cmd) {
-			phoneMsg := utils.PhoneMsg{CmdDelay: 1}
-			if strings.ToLower(phone_cmd) == "ath" {
-				phoneMsg.ATCmd = []byte(utils.CMD_ATH + utils.CMD_LF_CR)
-			} else {
-				phoneMsg.ATCmd = []byte(utils.CMD_ATD + phone_cmd + ";" + utils.CMD_LF_CR)
+	}
+	if text, label := utils.SplitModemLabel(req.Text); len(label) > 0 {
+		if _, err := utils.FindModem(modems, label); err != nil {
+			replyTo(req, err.Error())
+			return
+		}
+		req.Text, req.Modem = text, label
+	}
+	role := utils.RoleOf(config, req.User)
+	name, rest, _ := strings.Cut(utils.NormalizeCommand(req.Text), utils.CMD_SEP)
+	pending, err := confirmer.Take(req.User, req.Text)
+	if err != nil {
+		exec_result = err.Error()
+	} else if pending != nil {
+		log.Printf("%s confirmed command %s", req.User, pending.Summary)
+		exec_result = pending.Run()
+	} else if def, ok := cmdFile.Lookup(name); ok {
+		if role < cmdFileRole(def) {
+			exec_result = denyCmd(req, name)
+		} else {
+			var values []string
+			if len(rest) > 0 {
+				values = strings.Split(rest, utils.CMD_SEP)
+			}
+			name = def.Name()
+			summary = strings.Join(append([]string{name}, values...), " ")
+			run = func() string {
+				result, err := def.Execute(values)
+				if err != nil {
+					return err.Error()
+				}
+				return result
 			}
-			taskbus <- phoneMsg
+		}
+	} else if role == utils.ROLE_NONE {
+		exec_result = denyCmd(req, name)
+	} else {
+		parsed, err := registry.Parse(req.Text)
+		if err != nil {
+			exec_result = err.Error()
+		} else if role < parsed.Command.Role {
+			exec_result = denyCmd(req, parsed.Command.Name)
 		} else {
-			exec_result = "抱歉，手机号码有误"
+			summary = parsed.Summary()
+			name = parsed.Command.Name
+			run = func() string { return parsed.Command.Handler(req, parsed.Args) }
 		}
-	case "sms":
-		infos := strings.SplitN(strings.ReplaceAll(cmd, "sms::", ""), "::", 2)
-		phonecode := getStrUnicode(infos[0])
-		smsbody := getStrUnicode(infos[1])
-
-		if phone_num_rgx.MatchString(phonecode) {
-			set_message_format_cmd := []byte(utils.CMD_CMGF + utils.CMD_LF_CR)
-			smphoneMsg := utils.PhoneMsg{CmdDelay: 1}
-			smphoneMsg.ATCmd = set_message_format_cmd
-			taskbus <- smphoneMsg
-
-			ucs2cmd := []byte(utils.CMD_CSCS_UCS2 + utils.CMD_LF_CR)
-			setucs2 := utils.PhoneMsg{CmdDelay: 1}
-			setucs2.ATCmd = ucs2cmd
-			taskbus <- setucs2
-
-			csmpcmd := []byte(utils.CMD_CSMP + utils.CMD_LF_CR)
-			setcsmp := utils.PhoneMsg{CmdDelay: 1}
-			setcsmp.ATCmd = csmpcmd
-			taskbus <- setcsmp
-
-			phoneMsg := utils.PhoneMsg{CmdDelay: 2}
-
-			phoneMsg.ATCmd = []byte(utils.CMD_CMGS + phonecode + "\":::" + smsbody + utils.CMD_CTRL_Z)
-			taskbus <- phoneMsg
+	}
+	if run != nil {
+		if confirmer.Need(name) && (req.Source == "text" || req.Source == "voice") {
+			code := confirmer.Add(req, summary, run)
+			exec_result = fmt.Sprintf("即将执行: %s\n请在%d秒内回复确认码 %s", summary, int(confirmer.Timeout().Seconds()), code)
 		} else {
-			exec_result = "抱歉，手机号码有误"
+			exec_result = run()
 		}
-
-	default:
-		exec_result = "抱歉，未查到此: " + cmd + " 指令"
 	}
-	utils.SendWXMsg(exec_result, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+	if len(exec_result) > 0 {
+		replyTo(req, exec_result)
+	}
 }
 
-func readFileToMap(filename string) map[string]string {
-	result := make(map[string]string)
-	var k string
-	var v string
-	body, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Fatal("read file error %s", err)
-		return nil
-	}
-	for _, line := range strings.Split(string(body[:]), "\n") {
-		if strings.Contains(line, "::") {
-			str_array := strings.SplitN(line, "::", 2)
-			k, v = str_array[0], str_array[1]
-			result[k] = v
+// 回复指令的发起人, 没有发起人时发给wxuser; 短信指令的结果通过短信回复
+func replyTo(req utils.CmdRequest, body string) {
+	if req.Source == "sms" {
+		log.Printf("sms control reply to %s: %s", req.Phone, body)
+		for _, part := range utils.SplitSMS(body, SMS_REPLY_SIZE, SMS_REPLY_PARTS) {
+			sendSMS(modemOf(req), req.Phone, part, "")
 		}
+		notice := fmt.Sprintf("短信指令 %s (%s): %s\n%s", registry.Mask(req.Text), req.Phone, req.User, body)
+		utils.SendWXMsg(notice, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+		return
 	}
-	return result
+	touser := req.User
+	if len(touser) == 0 {
+		touser = config.WxUser
+	}
+	utils.SendWXMsg(body, config.WxAgentid, touser, wxAccessToken.AccessToken)
 }
 
-func process_command(command_bus chan string) {
+func process_command(command_bus chan utils.CmdRequest) {
 	for {
 		command := <-command_bus
-		command = strings.Replace(command, "。", "", -1)
-		command = strings.Replace(command, "，", "", -1)
-		command = strings.Replace(command, ",", "", -1)
-		cmdDict := readFileToMap(config.CMDFile)
-		executeCmd(command, cmdDict, taskbus)
+		executeCmd(command)
 	}
 }
 
@@ -185,9 +853,13 @@ func get_info(msg_send chan *utils.MSG) {
 		msg.MsgSignature = msg.MakeMsgSignature(config.TOKEN)
 		url := fmt.Sprintf("%s?msg_signature=%s&timestamp=%s&nonce=%s&echostr=%s", config.TargetURL, msg.MsgSignature, msg.Timestamp, msg.Nonce, msg.EchoStr)
 		resp, err := httpclient.Get(url)
-		msg.CheckErr(err)
+		if err != nil {
+			msg.CheckErr(err)
+			time.Sleep(time.Duration(1) * time.Second)
+			continue
+		}
 		resp_body, _ := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close()
+		resp.Body.Close()
 		if resp.StatusCode == int(200) && len(resp_body) > 0 && bytes.Compare(resp_body, []byte(config.FakeBody)) != 0 {
 			xml.Unmarshal(resp_body, msg)
 			xml.Unmarshal(msg.DecryptStr(msg.Encrypt, config.AESKEY), msg)
@@ -197,25 +869,36 @@ func get_info(msg_send chan *utils.MSG) {
 	}
 }
 
-func decrypt_message(msg_send chan *utils.MSG, command_bus chan string) {
+func decrypt_message(msg_send chan *utils.MSG, command_bus chan utils.CmdRequest) {
 	msg := &utils.MSG{}
-	bdVoice := &utils.BaiDuVoice{Rate: 8000, Channel: 1, DevPid: 1537, Cuid: config.BaiDuYuYingCuid}
 	for {
 		msg = <-msg_send
 		switch msg.MsgType {
 		case "voice":
-			wx_body, wx_len := utils.GetWXVoiceBody(wxAccessToken.AccessToken, msg.MediaId)
-			bdVoice.Token = baiDuAccessToken.AccessToken
-			bdVoice.Len = wx_len
-			bdVoice.Format = msg.Format
-			bdVoice.Speech = wx_body
-			bdVoiceResult := utils.GetBaiduVoiceResult(bdVoice)
-			if bdVoiceResult.ErrNo == 0 {
-				command_bus <- bdVoiceResult.Result[0]
+			var audio utils.Audio
+			var result utils.SpeechResult
+			data, err := utils.GetWXMedia(wxAccessToken.AccessToken, msg.MediaId)
+			if err == nil {
+				audio, err = audioPipeline.Convert(data, strings.ToLower(msg.Format))
+			}
+			if err == nil {
+				result, err = recognizer.Recognize(audio)
 			}
+			if err != nil {
+				log.Printf("voice from %s: %v", msg.FromUserName, err)
+				utils.SendWXMsg("语音识别失败: "+err.Error(), config.WxAgentid, msg.FromUserName, wxAccessToken.AccessToken)
+				continue
+			}
+			log.Printf("voice from %s (%s): %s", msg.FromUserName, recognizer.Name(), result.Summary())
+			if !result.Confident(config.SpeechConfidence) {
+				notice := "语音识别结果不确定, 未执行, 请确认后发送文字指令:\n" + result.Summary()
+				utils.SendWXMsg(notice, config.WxAgentid, msg.FromUserName, wxAccessToken.AccessToken)
+				continue
+			}
+			command_bus <- utils.CmdRequest{User: msg.FromUserName, Text: result.Text, Source: "voice"}
 		case "text":
 			if len(wxAccessToken.AccessToken) > 0 {
-				command_bus <- msg.Content
+				command_bus <- utils.CmdRequest{User: msg.FromUserName, Text: msg.Content, Source: "text"}
 			}
 		default:
 			fmt.Println(msg.MsgType)
@@ -223,42 +906,143 @@ func decrypt_message(msg_send chan *utils.MSG, command_bus chan string) {
 	}
 }
 
-func get_temp(filename string) (float32, error) {
-	content, err := ioutil.ReadFile(filename)
+// 未接来电和语音留言通过微信和邮件通知, 留言录音作为语音消息或附件发送
+func process_voicemail(modem *utils.Modem, record utils.VoicemailRecord) {
+	body := modem.Tag() + record.String()
+	subject := modem.Tag() + "未接来电"
+	if len(record.File) > 0 {
+		subject = modem.Tag() + "语音留言 " + record.Caller
+		if config.VoicemailTranscribe {
+			body += "\n" + transcribe(record.File)
+		}
+	}
+	log.Printf("voicemail: %s", strings.Replace(body, "\n", " ", -1))
+	if config.SendWX {
+		utils.SendWXMsg(body, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+		if len(record.File) > 0 {
+			utils.SendWXFile(record.File, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+		}
+	}
+	if config.SendMail {
+		if len(record.File) > 0 {
+			utils.SendMailFile(body, subject, record.File, config)
+		} else {
+			utils.SendMail(body, subject, config)
+		}
+	}
+}
+
+func transcribe(file string) string {
+	data, err := ioutil.ReadFile(file)
+	var audio utils.Audio
+	var result utils.SpeechResult
+	if err == nil {
+		audio, err = audioPipeline.Convert(data, strings.TrimPrefix(filepath.Ext(file), "."))
+	}
+	if err == nil {
+		result, err = recognizer.Recognize(audio)
+	}
 	if err != nil {
-		return 0.0, err
+		return "语音识别失败: " + err.Error()
 	}
+	return "留言内容: " + result.Summary()
+}
 
-	tmp, err := strconv.Atoi(strings.TrimSpace(string(content[:])))
+// 名称和时长之间可以用空格或::分隔
+func cmdSensor(req utils.CmdRequest, args utils.CmdArgs) string {
+	fields := strings.Fields(strings.Replace(args["参数"], utils.CMD_SEP, " ", -1))
+	if len(fields) == 0 {
+		return sensors.Summary()
+	}
+	window := utils.DEFAULT_SENSOR_WINDOW
+	if len(fields) > 1 {
+		var err error
+		if window, err = utils.ParseEvery(fields[1]); err != nil {
+			return err.Error()
+		}
+	}
+	stats, err := sensors.Stats(fields[0], window)
 	if err != nil {
-		return 0.0, err
+		return err.Error()
 	}
+	return stats.String()
+}
 
-	cpu_temp := float32(tmp) / 1000
-	return cpu_temp, nil
+// modempowerpin控制模块电源的继电器, 拉低断电几秒后重新上电
+func power_cycle_modem(pin uint) {
+	if err := rpio.Open(); err != nil {
+		log.Printf("gpio open error: %v", err)
+		return
+	}
+	//风扇控制还在使用GPIO时不能关闭
+	if fan == nil {
+		defer rpio.Close()
+	}
+	power := rpio.Pin(pin)
+	power.Output()
+	power.Low()
+	time.Sleep(time.Duration(3) * time.Second)
+	power.High()
 }
 
-func control_cpu_fan(cpu_temp_file string, timeout time.Duration, cpu_temp float32) {
-	err := rpio.Open()
-	utils.CheckErr(err)
-	defer rpio.Close()
-	fan_contrl := rpio.Pin(config.CPUFanConPin)
-	fan_contrl.Output()
-	for {
-		temp, err := get_temp(cpu_temp_file)
-		utils.CheckErr(err)
-		diff_num := int(temp - cpu_temp)
+// 风扇接在硬件PWM引脚(GPIO12/13/18/19)时可以调速, 否则只能开关
+type rpioFan struct {
+	pin rpio.Pin
+	pwm bool
+}
 
-		if diff_num > 2 {
-			fan_contrl.High()
-		}
+const fanCycle uint32 = 100
 
-		if diff_num < -5 {
-			fan_contrl.Low()
-		}
-		time.Sleep(timeout * time.Minute)
+func newRpioFan(fan utils.FanConfig) (*rpioFan, error) {
+	if err := rpio.Open(); err != nil {
+		return nil, err
+	}
+	f := &rpioFan{pin: rpio.Pin(fan.Pin), pwm: fan.PWM}
+	if f.pwm {
+		f.pin.Mode(rpio.Pwm)
+		f.pin.Freq(fan.Freq * int(fanCycle))
+	} else {
+		f.pin.Output()
 	}
+	return f, nil
+}
 
+func (f *rpioFan) SetDuty(duty int) error {
+	if f.pwm {
+		f.pin.DutyCycle(uint32(duty), fanCycle)
+	} else if duty > 0 {
+		f.pin.High()
+	} else {
+		f.pin.Low()
+	}
+	return nil
+}
+
+func cmdFan(req utils.CmdRequest, args utils.CmdArgs) string {
+	if fan == nil {
+		return "没有开启风扇控制(checkcputemp)"
+	}
+	arg := strings.ToLower(args["占空比"])
+	var err error
+	switch arg {
+	case "":
+	case "auto", "自动":
+		err = fan.Override(utils.FAN_AUTO)
+	case "on", "开", "全速":
+		err = fan.Override(100)
+	case "off", "关", "停止":
+		err = fan.Override(0)
+	default:
+		duty, perr := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+		if perr != nil {
+			return "参数应为 auto、on、off 或 0-100 的占空比"
+		}
+		err = fan.Override(duty)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return fan.Status()
 }
 
 func main() {
@@ -271,27 +1055,103 @@ func main() {
 		panic(err)
 	}
 	json.Unmarshal(file_body, &config)
+	if !utils.HasAdmin(config) {
+		log.Printf("no admin in acl, all accounts are %s", utils.RoleName(utils.RoleOf(config, "")))
+	}
+	jobRunner = utils.NewJobRunner(config)
+	confirmer = utils.NewConfirmer(config)
+	otpStore = utils.NewOTPStore(config)
+	smsRules = utils.NewSMSRules(config)
+	smsControl = utils.NewSMSControl(config)
+	modems = utils.NewModems(config, func(modem *utils.Modem, msg string) {
+		utils.SendWXMsg(modem.Tag()+"模块状态: "+msg, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+	})
+	//扩展指令不能与内置指令重名, 需要先注册内置指令
+	registerCommands()
+	cmdFile, err = utils.NewCmdFile(config.CMDFile, func(name string) bool { return registry.Lookup(name) != nil })
+	if err != nil {
+		log.Printf("load %s error: %v", config.CMDFile, err)
+	}
+	audioPipeline = utils.NewAudioPipeline(config)
+	intents = utils.NewIntentMatcher(config)
+	recognizer, err = utils.NewSpeechRecognizer(config, func() string { return baiDuAccessToken.AccessToken })
+	if err != nil {
+		panic(err)
+	}
+	sensors, err = utils.NewSensorHub(config, func(msg string) {
+		log.Printf("sensor: %s", msg)
+		utils.SendWXMsg(msg, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+	})
+	if err != nil {
+		panic(err)
+	}
+	smsRules.CheckActions(checkRuleAction)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	recvmsg_bus := make(chan *utils.MSG, 10)
-	command_bus := make(chan string, 10)
+	command_bus := make(chan utils.CmdRequest, 10)
+	sms_bus := make(chan utils.SMS, 100)
+	scheduler = utils.NewScheduler(config, func(job utils.ScheduleJob) {
+		user := job.User
+		if len(user) == 0 {
+			user = strings.Split(config.WxUser, "|")[0]
+		}
+		command_bus <- utils.CmdRequest{User: user, Text: job.Command, Source: "cron"}
+	})
 
 	go utils.GetWXAccessToken(&wxAccessToken, config.WxCorpid, config.WxCorpSecret)
-	go utils.GetBaiDuYuYingAccessToken(&baiDuAccessToken, config.BaiDuYuYingKey, config.BaiDuYuYingSecret)
+	//只有使用百度语音识别时才需要获取百度的token
+	if recognizer.Name() == utils.SPEECH_BAIDU {
+		go utils.GetBaiDuYuYingAccessToken(&baiDuAccessToken, config.BaiDuYuYingKey, config.BaiDuYuYingSecret)
+	}
 
 	go get_info(recvmsg_bus)
 	go decrypt_message(recvmsg_bus, command_bus)
 	go process_command(command_bus)
+	go process_sms(sms_bus, command_bus)
+
+	go scheduler.Run()
+	go cmdFile.Watch(time.Duration(2)*time.Second, func(err error) {
+		notice := fmt.Sprintf("扩展指令文件 %s 加载失败, 继续使用上一次的指令: %v", config.CMDFile, err)
+		utils.SendWXMsg(notice, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+	})
 
+	sensors.Run()
 	if config.CheckCpuTemp {
-		go control_cpu_fan(config.CPUTempFile, time.Duration(config.TempInterval), config.CPUFanStart)
+		fanConfig := utils.NewFanConfig(config)
+		//GPIO打不开时不能控制风扇, 只记录日志, 不影响短信功能
+		if driver, err := newRpioFan(fanConfig); err != nil {
+			log.Printf("gpio open error: %v", err)
+		} else {
+			fan = utils.NewFanController(fanConfig, driver, func(msg string) {
+				log.Printf("fan: %s", msg)
+				utils.SendWXMsg(msg, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+			})
+			go fan.Run()
+		}
 	}
 
-	go utils.AddCycleATCmd(taskbus)
-	go utils.ExecATCmd(taskbus, resultbus, config)
-	go utils.ProcessATcmdResult(resultbus, &config, &wxAccessToken.AccessToken)
+	//每个模块有独立的指令队列和串口
+	for _, modem := range modems {
+		modem := modem
+		var powerCycle func()
+		if modem.Config.ModemPowerPin > 0 {
+			powerCycle = func() { power_cycle_modem(modem.Config.ModemPowerPin) }
+		}
+		go utils.AddCycleATCmd(modem.Tasks, modem.Config.Dialect)
+		go modem.Monitor.Run(modem.Tasks)
+		go utils.ExecATCmd(modem, func(msg string) {
+			log.Printf("modem %s: %s", modem.Label, msg)
+			utils.SendWXMsg(modem.Tag()+"模块状态: "+msg, config.WxAgentid, config.WxUser, wxAccessToken.AccessToken)
+		}, powerCycle)
+		go utils.ProcessATcmdResult(modem, &wxAccessToken.AccessToken, otpStore, sms_bus)
+		go modem.Voicemail.Run(func(record utils.VoicemailRecord) { process_voicemail(modem, record) })
+	}
+	if len(config.OTPListen) > 0 {
+		go otpStore.Listen(config.OTPListen)
+	}
 
 	wg.Wait()
 }
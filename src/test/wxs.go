@@ -9,11 +9,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 	"utils"
 )
 
 var REALBODY string = ""
 var wxsconfig utils.Config
+var ipguard *utils.IPGuard
 
 func handleCheckFunc(w http.ResponseWriter, req *http.Request) {
 	msg := &utils.MSG{}
@@ -21,17 +23,25 @@ func handleCheckFunc(w http.ResponseWriter, req *http.Request) {
 	msg.Timestamp = req.URL.Query().Get("timestamp")
 	msg.Nonce = req.URL.Query().Get("nonce")
 	msg.EchoStr = req.URL.Query().Get("echostr")
+	ip := utils.ClientIP(req)
 	if msg.Verify(wxsconfig.TOKEN) && req.Method == "GET" {
+		ipguard.Success(ip)
 		w.Write(msg.DecryptStr(msg.EchoStr, wxsconfig.AESKEY))
 	} else if req.Method == "POST" {
 		body, _ := ioutil.ReadAll(req.Body)
 		err := xml.Unmarshal(body, &msg)
 		msg.CheckErr(err)
 		if msg.Verify(wxsconfig.TOKEN) {
+			ipguard.Success(ip)
 			REALBODY = string(body[:])
+		} else {
+			ipguard.Fail(ip)
 		}
 		defer req.Body.Close()
 	} else {
+		if len(msg.MsgSignature) > 0 {
+			ipguard.Fail(ip)
+		}
 		w.Write([]byte(wxsconfig.FakeBody))
 	}
 }
@@ -46,7 +56,7 @@ func handleRootFunc(w http.ResponseWriter, req *http.Request) {
 	msg.Nonce = req.URL.Query().Get("nonce")
 	msg.EchoStr = req.URL.Query().Get("echostr")
 	msg.Encrypt = ""
-	if req.Method == "GET" && msg.Verify(wxsconfig.TOKEN) && (string(msg.DecryptStr(msg.EchoStr, wxsconfig.AESKEY)) == wxsconfig.SecretWord) && (len(REALBODY) > 0) {
+	if req.Method == "GET" && checkSecretWord(req, msg) && (len(REALBODY) > 0) {
 		w.Write([]byte(REALBODY))
 		REALBODY = ""
 	} else {
@@ -54,6 +64,53 @@ func handleRootFunc(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// 校验签名以及口令, 只有携带签名参数的请求才计入失败次数
+func checkSecretWord(req *http.Request, msg *utils.MSG) bool {
+	ip := utils.ClientIP(req)
+	if len(msg.MsgSignature) == 0 {
+		return false
+	}
+	if msg.Verify(wxsconfig.TOKEN) && (string(msg.DecryptStr(msg.EchoStr, wxsconfig.AESKEY)) == wxsconfig.SecretWord) {
+		ipguard.Success(ip)
+		return true
+	}
+	ipguard.Fail(ip)
+	return false
+}
+
+func handleAdminFunc(w http.ResponseWriter, req *http.Request) {
+	msg := &utils.MSG{}
+	msg.MsgSignature = req.URL.Query().Get("msg_signature")
+	msg.Timestamp = req.URL.Query().Get("timestamp")
+	msg.Nonce = req.URL.Query().Get("nonce")
+	msg.EchoStr = req.URL.Query().Get("echostr")
+	if req.Method == "GET" && checkSecretWord(req, msg) {
+		result := map[string]interface{}{"bans": ipguard.Bans(), "events": ipguard.Events()}
+		body, _ := json.Marshal(result)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	} else {
+		w.Write([]byte(wxsconfig.FakeBody))
+	}
+}
+
+func guardRequest(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ipguard.Allow(utils.ClientIP(r)) {
+			w.Write([]byte(wxsconfig.FakeBody))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func cleanupGuard() {
+	for {
+		time.Sleep(time.Duration(1) * time.Minute)
+		ipguard.Cleanup()
+	}
+}
+
 func addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Server", wxsconfig.HeaderServer)
@@ -71,11 +128,16 @@ func main() {
 		panic(err)
 	}
 	json.Unmarshal(file_body, &wxsconfig)
+	ipguard = utils.NewIPGuard(wxsconfig)
+	go cleanupGuard()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", addDefaultHeaders(handleRootFunc))
-	mux.HandleFunc(wxsconfig.CheckURL, addDefaultHeaders(handleCheckFunc))
-	mux.HandleFunc("/*", addDefaultHeaders(handleAllFunc))
+	mux.HandleFunc("/", addDefaultHeaders(guardRequest(handleRootFunc)))
+	mux.HandleFunc(wxsconfig.CheckURL, addDefaultHeaders(guardRequest(handleCheckFunc)))
+	mux.HandleFunc("/*", addDefaultHeaders(guardRequest(handleAllFunc)))
+	if len(wxsconfig.AdminURL) > 0 {
+		mux.HandleFunc(wxsconfig.AdminURL, addDefaultHeaders(guardRequest(handleAdminFunc)))
+	}
 
 	addr := fmt.Sprintf(":%d", wxsconfig.Port)
 	if wxsconfig.SSL {
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"strings"
+)
+
+const (
+	ROLE_NONE     int = iota //未授权
+	ROLE_VIEWER              //只能查看信息
+	ROLE_OPERATOR            //可以发短信, 打电话以及执行扩展指令
+	ROLE_ADMIN               //可以执行cmd::等所有指令
+)
+
+var roleNames = map[string]int{
+	"none":     ROLE_NONE,
+	"viewer":   ROLE_VIEWER,
+	"operator": ROLE_OPERATOR,
+	"admin":    ROLE_ADMIN,
+}
+
+func ParseRole(name string) int {
+	return roleNames[strings.ToLower(strings.TrimSpace(name))]
+}
+
+func RoleName(role int) string {
+	for k, v := range roleNames {
+		if v == role {
+			return k
+		}
+	}
+	return "none"
+}
+
+// 只有acl中明确配置的账号才有对应的角色, 其余账号(包括wxuser中的账号)为defaultrole, 未配置defaultrole时只能查看
+func RoleOf(config Config, user string) int {
+	if role, ok := config.ACL[user]; ok {
+		return ParseRole(role)
+	}
+	if len(config.DefaultRole) == 0 {
+		return ROLE_VIEWER
+	}
+	return ParseRole(config.DefaultRole)
+}
+
+// 没有任何账号是admin时返回false, 启动时提醒配置acl
+func HasAdmin(config Config) bool {
+	for _, role := range config.ACL {
+		if ParseRole(role) == ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
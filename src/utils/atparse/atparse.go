@@ -0,0 +1,138 @@
+package atparse
+
+import (
+	"strconv"
+	"strings"
+)
+
+type field struct {
+	value  string
+	quoted bool
+}
+
+// 按行拆分模块返回的结果, 去掉\r和读取缓冲区末尾的\x00, 保留空行
+func Lines(raw string) []string {
+	raw = strings.TrimRight(raw, "\x00")
+	lines := strings.Split(raw, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return lines
+}
+
+// 以 +XXX: 开头的行返回冒号后面的内容
+func payload(line string, prefix string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, prefix+":") {
+		return "", false
+	}
+	return strings.TrimSpace(line[len(prefix)+1:]), true
+}
+
+// 按逗号拆分字段, 引号中的逗号不拆分, 缺少结束引号时取到行尾
+func splitFields(s string) []field {
+	var fields []field
+	var cur strings.Builder
+	quoted, inQuote := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			quoted = true
+		case r == ',' && !inQuote:
+			fields = append(fields, field{value: strings.TrimSpace(cur.String()), quoted: quoted})
+			cur.Reset()
+			quoted = false
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	return append(fields, field{value: strings.TrimSpace(cur.String()), quoted: quoted})
+}
+
+// 拆分字段并去掉引号, 便于解析其他厂商的扩展指令
+func Fields(s string) []string {
+	var values []string
+	for _, f := range splitFields(s) {
+		values = append(values, f.value)
+	}
+	return values
+}
+
+// 不存在或不是数字时返回def
+func intField(fields []field, i int, def int) int {
+	if i >= len(fields) {
+		return def
+	}
+	v, err := strconv.Atoi(fields[i].value)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func strField(fields []field, i int) string {
+	if i >= len(fields) {
+		return ""
+	}
+	return fields[i].value
+}
+
+// 结果中是否有最终的OK
+func OK(raw string) bool {
+	for _, line := range Lines(raw) {
+		if strings.TrimSpace(line) == "OK" {
+			return true
+		}
+	}
+	return false
+}
+
+// 最后一个不是主动上报的非空行, 最终结果码只会出现在这一行; 没有时返回-1
+func finalIndex(lines []string) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if len(line) > 0 && !isUnsolicited(line) {
+			return i
+		}
+	}
+	return -1
+}
+
+func finalLine(raw string) string {
+	lines := Lines(raw)
+	if i := finalIndex(lines); i >= 0 {
+		return strings.TrimSpace(lines[i])
+	}
+	return ""
+}
+
+// 结果是否已经以最终结果码结束, 包括拨号的结果码, 用于判断是否需要继续读取
+func Final(raw string) bool {
+	switch line := finalLine(raw); line {
+	case "NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE":
+		return true
+	default:
+		return isFinal(line)
+	}
+}
+
+func isFinal(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "OK" || line == "ERROR" || strings.HasPrefix(line, "+CME ERROR:") || strings.HasPrefix(line, "+CMS ERROR:")
+}
+
+// 可能夹在其他指令结果中的主动上报
+var unsolicited = []string{"+CMTI", "+CDSI", "+CDS", "+CLIP", "+CRING", "+CUSD"}
+
+func isUnsolicited(line string) bool {
+	if strings.TrimSpace(line) == "RING" {
+		return true
+	}
+	for _, prefix := range unsolicited {
+		if _, ok := payload(line, prefix); ok {
+			return true
+		}
+	}
+	return false
+}
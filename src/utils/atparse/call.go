@@ -0,0 +1,27 @@
+package atparse
+
+// +CLCC: <id>,<dir>,<stat>,<mode>,<mpty>[,<number>,<type>[,<alpha>]]
+// Dir 0为呼出; Stat 0通话中 1保持 2拨号中 3振铃中 4来电 5等待; Mode 0为语音
+type Call struct {
+	ID     int
+	Dir    int
+	Stat   int
+	Mode   int
+	Number string
+}
+
+func ParseCLCC(raw string) []Call {
+	var calls []Call
+	for _, line := range Lines(raw) {
+		p, ok := payload(line, "+CLCC")
+		if !ok {
+			continue
+		}
+		f := splitFields(p)
+		call := Call{ID: intField(f, 0, -1), Dir: intField(f, 1, -1), Stat: intField(f, 2, -1), Mode: intField(f, 3, -1), Number: strField(f, 5)}
+		if call.ID >= 0 && call.Stat >= 0 {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
@@ -0,0 +1,49 @@
+package atparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCLCC(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want []Call
+	}{
+		{
+			name: "ec20 incoming",
+			raw:  "AT+CLCC\r\r\n+CLCC: 1,1,4,0,0,\"+8613700000000\",145,\"\"\r\n\r\nOK\r\n",
+			want: []Call{{ID: 1, Dir: 1, Stat: 4, Mode: 0, Number: "+8613700000000"}},
+		},
+		{
+			name: "sim900a outgoing and waiting",
+			raw: "\r\n+CLCC: 1,0,0,0,0,\"10086\",129,\"\"\r\n" +
+				"+CLCC: 2,1,5,0,0,\"+8613700000000\",145,\"Zhang, San\"\r\n\r\nOK\r\n",
+			want: []Call{
+				{ID: 1, Dir: 0, Stat: 0, Mode: 0, Number: "10086"},
+				{ID: 2, Dir: 1, Stat: 5, Mode: 0, Number: "+8613700000000"},
+			},
+		},
+		{
+			name: "withheld number",
+			raw:  "\r\n+CLCC: 1,1,4,0,0\r\n\r\nOK\r\n",
+			want: []Call{{ID: 1, Dir: 1, Stat: 4, Mode: 0}},
+		},
+		{
+			name: "no call",
+			raw:  "AT+CLCC\r\r\nOK\r\n",
+			want: nil,
+		},
+		{
+			name: "truncated",
+			raw:  "\r\n+CLCC: 1,",
+			want: nil,
+		},
+	}
+	for _, c := range cases {
+		if got := ParseCLCC(c.raw); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\ngot  %#v\nwant %#v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package atparse
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "重新生成testdata中的.json")
+
+// testdata中每个.at文件是串口读到的原始内容(保留\r\n), 同名的.json是各个解析函数的结果
+// 现有文件按SIM900A和EC20手册中的输出格式整理, 不是硬件抓包
+// 新的抓包可以直接放入testdata, 用 go test -run TestCorpus -update 生成.json后人工核对
+type corpusResult struct {
+	OK          bool           `json:"ok"`
+	Final       bool           `json:"final"`
+	Error       *Error         `json:"error,omitempty"`
+	CMGL        []SMS          `json:"cmgl,omitempty"`
+	CMGR        *SMS           `json:"cmgr,omitempty"`
+	CMGS        int            `json:"cmgs"`
+	CDS         []StatusReport `json:"cds,omitempty"`
+	Indications []Indication   `json:"indications,omitempty"`
+	CSQ         *Signal        `json:"csq,omitempty"`
+	COPS        *Operator      `json:"cops,omitempty"`
+	CREG        []Registration `json:"creg,omitempty"`
+	CLIP        *CallerID      `json:"clip,omitempty"`
+	Rings       int            `json:"rings,omitempty"`
+	CUSD        *USSD          `json:"cusd,omitempty"`
+	CLCC        []Call         `json:"clcc,omitempty"`
+}
+
+func parseCorpus(raw string) corpusResult {
+	r := corpusResult{
+		OK:          OK(raw),
+		Final:       Final(raw),
+		Error:       ParseError(raw),
+		CMGL:        ParseCMGL(raw),
+		CMGS:        ParseCMGS(raw),
+		CDS:         ParseCDS(raw),
+		Indications: ParseIndications(raw),
+		CREG:        ParseCREG(raw),
+		CLCC:        ParseCLCC(raw),
+		Rings:       ParseRings(raw),
+	}
+	if msg, ok := ParseCMGR(raw); ok {
+		r.CMGR = &msg
+	}
+	if csq, ok := ParseCSQ(raw); ok {
+		r.CSQ = &csq
+	}
+	if op, ok := ParseCOPS(raw); ok {
+		r.COPS = &op
+	}
+	if id, ok := ParseCLIP(raw); ok {
+		r.CLIP = &id
+	}
+	if u, ok := ParseCUSD(raw); ok {
+		r.CUSD = &u
+	}
+	return r
+}
+
+func TestCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.at"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("testdata中没有.at文件")
+	}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.MarshalIndent(parseCorpus(string(raw)), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, '\n')
+		golden := strings.TrimSuffix(file, ".at") + ".json"
+		if *update {
+			if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: %v, 用 -update 生成", file, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s:\ngot  %s\nwant %s", file, got, want)
+		}
+	}
+}
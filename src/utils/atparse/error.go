@@ -0,0 +1,121 @@
+package atparse
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// 3GPP TS 27.007 中常见的 +CME ERROR 错误码
+var cmeErrors = map[int]string{
+	0:   "模块故障",
+	3:   "不允许的操作",
+	4:   "不支持的操作",
+	5:   "需要PH-SIM PIN",
+	10:  "SIM卡未插入",
+	11:  "需要SIM卡PIN",
+	12:  "需要SIM卡PUK",
+	13:  "SIM卡故障",
+	14:  "SIM卡忙",
+	15:  "SIM卡错误",
+	16:  "密码错误",
+	17:  "需要SIM卡PIN2",
+	18:  "需要SIM卡PUK2",
+	20:  "存储已满",
+	21:  "无效的存储位置",
+	22:  "未找到",
+	23:  "存储故障",
+	24:  "文本太长",
+	25:  "文本中有无效字符",
+	26:  "号码太长",
+	27:  "号码中有无效字符",
+	30:  "无网络服务",
+	31:  "网络超时",
+	32:  "网络不允许, 只能拨打紧急电话",
+	100: "未知错误",
+}
+
+// 3GPP TS 27.005 中常见的 +CMS ERROR 错误码, 小于256的为网络返回的原因
+var cmsErrors = map[int]string{
+	1:   "号码未分配",
+	8:   "运营商禁止",
+	10:  "呼叫被限制",
+	21:  "短信被拒绝",
+	27:  "目标不可达",
+	28:  "号码格式错误",
+	29:  "不支持的业务",
+	30:  "未知用户",
+	38:  "网络故障",
+	41:  "临时故障",
+	42:  "网络拥塞",
+	47:  "资源不可用",
+	50:  "未订购该业务",
+	69:  "未实现的业务",
+	300: "模块故障",
+	301: "短信服务被占用",
+	302: "不允许的操作",
+	303: "不支持的操作",
+	304: "无效的PDU模式参数",
+	305: "无效的文本模式参数",
+	310: "SIM卡未插入",
+	311: "需要SIM卡PIN",
+	312: "需要PH-SIM PIN",
+	313: "SIM卡故障",
+	314: "SIM卡忙",
+	315: "SIM卡错误",
+	316: "需要SIM卡PUK",
+	320: "存储故障",
+	321: "无效的存储位置",
+	322: "存储已满",
+	330: "短信中心号码未知",
+	331: "无网络服务",
+	332: "网络超时",
+	340: "不需要+CNMA确认",
+	500: "未知错误",
+}
+
+// 指令执行失败, Kind为CME或CMS, 只返回ERROR时Kind为空; 开启AT+CMEE=2时Code为-1, Message为模块返回的文字
+type Error struct {
+	Kind    string
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if len(e.Kind) == 0 {
+		return "ERROR"
+	}
+	if e.Code < 0 {
+		return fmt.Sprintf("+%s ERROR: %s", e.Kind, e.Message)
+	}
+	return fmt.Sprintf("+%s ERROR %d: %s", e.Kind, e.Code, e.Message)
+}
+
+func Describe(kind string, code int) string {
+	table := cmeErrors
+	if kind == "CMS" {
+		table = cmsErrors
+	}
+	if msg, ok := table[code]; ok {
+		return msg
+	}
+	return "未知错误"
+}
+
+// 返回结果中的错误, 没有错误时返回nil; 只看最终结果所在的行, 短信正文中的ERROR不算
+func ParseError(raw string) *Error {
+	line := finalLine(raw)
+	if line == "ERROR" {
+		return &Error{Code: -1, Message: "ERROR"}
+	}
+	for _, kind := range []string{"CME", "CMS"} {
+		p, ok := payload(line, "+"+kind+" ERROR")
+		if !ok {
+			continue
+		}
+		if code, err := strconv.Atoi(p); err == nil {
+			return &Error{Kind: kind, Code: code, Message: Describe(kind, code)}
+		}
+		return &Error{Kind: kind, Code: -1, Message: p}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package atparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want *Error
+	}{
+		{"ok", "AT\r\r\nOK\r\n", nil},
+		{"plain error", "AT+QPINC=\"SC\"\r\r\nERROR\r\n", &Error{Code: -1, Message: "ERROR"}},
+		{"cme numeric", "AT+CPIN?\r\r\n+CME ERROR: 10\r\n", &Error{Kind: "CME", Code: 10, Message: "SIM卡未插入"}},
+		{"cme verbose", "\r\n+CME ERROR: SIM not inserted\r\n", &Error{Kind: "CME", Code: -1, Message: "SIM not inserted"}},
+		{"cms numeric", "AT+CMGS=\"10086\"\r\r\n> hi\x1a\r\n+CMS ERROR: 330\r\n", &Error{Kind: "CMS", Code: 330, Message: "短信中心号码未知"}},
+		{"cms unknown code", "\r\n+CMS ERROR: 999\r\n", &Error{Kind: "CMS", Code: 999, Message: "未知错误"}},
+		{"error inside sms body is ignored", "\r\n+CMGR: \"REC READ\",\"10086\",,\"24/10/19,08:30:12+32\"\r\nERROR 404, page\r\n\r\nOK\r\n", nil},
+		{"error line in sms body is ignored", "\r\n+CMGR: \"REC READ\",\"10086\",,\"24/10/19,08:30:12+32\"\r\nresult:\r\nERROR\r\n\r\nOK\r\n", nil},
+		{"error after body", "\r\n+CMGL: 1,\"REC READ\",\"10086\",,\"24/10/19,08:30:12+32\"\r\nOK\r\n\r\n+CMS ERROR: 321\r\n", &Error{Kind: "CMS", Code: 321, Message: Describe("CMS", 321)}},
+	}
+	for _, c := range cases {
+		if got := ParseError(c.raw); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %#v, want %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	cases := map[string]*Error{
+		"ERROR":                    {Code: -1, Message: "ERROR"},
+		"+CME ERROR 11: 需要SIM卡PIN": {Kind: "CME", Code: 11, Message: "需要SIM卡PIN"},
+		"+CMS ERROR: SMSC unknown": {Kind: "CMS", Code: -1, Message: "SMSC unknown"},
+	}
+	for want, e := range cases {
+		if got := e.Error(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestOK(t *testing.T) {
+	if !OK("AT\r\r\nOK\r\n\x00") {
+		t.Errorf("OK not found")
+	}
+	if OK("\r\n+CMGR: \"REC READ\",\"10086\",,\"24/10/19,08:30:12+32\"\r\nOK then\r\n") {
+		t.Errorf("truncated result should not be OK")
+	}
+}
@@ -0,0 +1,130 @@
+package atparse
+
+import (
+	"strings"
+)
+
+// +CSQ: <rssi>,<ber>, 99表示未知
+type Signal struct {
+	RSSI int
+	BER  int
+}
+
+// 注册状态, LTE为true时来自+CEREG
+type Registration struct {
+	LTE  bool
+	Stat int
+}
+
+// +COPS: <mode>[,<format>,<oper>[,<AcT>]], 未注册时Name为空, AcT为-1
+type Operator struct {
+	Mode   int
+	Format int
+	Name   string
+	AcT    int
+}
+
+// +CLIP: <number>,<type>[,<subaddr>,<satype>,<alpha>,<CLI validity>]
+type CallerID struct {
+	Number string
+	Type   int
+	Alpha  string
+}
+
+// +CUSD: <m>[,<str>[,<dcs>]], 没有dcs时按15(GSM-7)处理
+type USSD struct {
+	Status int
+	Text   string
+	DCS    int
+}
+
+// 换算为dBm, 未知时返回0
+func (s Signal) DBm() int {
+	if s.RSSI < 0 || s.RSSI > 31 {
+		return 0
+	}
+	return -113 + 2*s.RSSI
+}
+
+func ParseCSQ(raw string) (Signal, bool) {
+	for _, line := range Lines(raw) {
+		if p, ok := payload(line, "+CSQ"); ok {
+			f := splitFields(p)
+			s := Signal{RSSI: intField(f, 0, -1), BER: intField(f, 1, 99)}
+			if s.RSSI >= 0 {
+				return s, true
+			}
+		}
+	}
+	return Signal{}, false
+}
+
+// 查询结果为 +CREG: <n>,<stat>[,<lac>,<ci>[,<AcT>]], 主动上报为 +CREG: <stat>[,<lac>,<ci>[,<AcT>]]
+// 上报中的lac带引号, 以此区分两种格式
+func ParseCREG(raw string) []Registration {
+	var regs []Registration
+	for _, line := range Lines(raw) {
+		for _, prefix := range []string{"+CREG", "+CEREG", "+CGREG"} {
+			p, ok := payload(line, prefix)
+			if !ok {
+				continue
+			}
+			f := splitFields(p)
+			stat := intField(f, 0, -1)
+			if len(f) > 1 && !f[1].quoted {
+				stat = intField(f, 1, -1)
+			}
+			if stat >= 0 {
+				regs = append(regs, Registration{LTE: prefix == "+CEREG", Stat: stat})
+			}
+		}
+	}
+	return regs
+}
+
+func ParseCOPS(raw string) (Operator, bool) {
+	for _, line := range Lines(raw) {
+		if p, ok := payload(line, "+COPS"); ok {
+			f := splitFields(p)
+			op := Operator{Mode: intField(f, 0, -1), Format: intField(f, 1, -1), Name: strField(f, 2), AcT: intField(f, 3, -1)}
+			if op.Mode >= 0 {
+				return op, true
+			}
+		}
+	}
+	return Operator{}, false
+}
+
+func ParseCLIP(raw string) (CallerID, bool) {
+	for _, line := range Lines(raw) {
+		if p, ok := payload(line, "+CLIP"); ok {
+			f := splitFields(p)
+			return CallerID{Number: strField(f, 0), Type: intField(f, 1, -1), Alpha: strField(f, 4)}, true
+		}
+	}
+	return CallerID{}, false
+}
+
+// 振铃上报的次数, 只统计单独成行的RING和+CRING, 正文或二进制内容中的RING不计
+func ParseRings(raw string) int {
+	rings := 0
+	for _, line := range Lines(raw) {
+		if _, ok := payload(line, "+CRING"); ok || strings.TrimSpace(line) == "RING" {
+			rings++
+		}
+	}
+	return rings
+}
+
+func ParseCUSD(raw string) (USSD, bool) {
+	for _, line := range Lines(raw) {
+		if p, ok := payload(line, "+CUSD"); ok {
+			f := splitFields(p)
+			u := USSD{Status: intField(f, 0, -1), Text: strField(f, 1), DCS: intField(f, 2, 15)}
+			if u.Status >= 0 {
+				return u, true
+			}
+		}
+	}
+	return USSD{}, false
+}
@@ -0,0 +1,111 @@
+package atparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCSQ(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want Signal
+		ok   bool
+		dbm  int
+	}{
+		{"AT+CSQ\r\r\n+CSQ: 24,99\r\n\r\nOK\r\n", Signal{RSSI: 24, BER: 99}, true, -65},
+		{"\r\n+CSQ: 99,99\r\n\r\nOK\r\n", Signal{RSSI: 99, BER: 99}, true, 0},
+		{"\r\n+CSQ: 18\r\n", Signal{RSSI: 18, BER: 99}, true, -77},
+		{"\r\n+CSQ: ", Signal{}, false, 0},
+		{"\r\nERROR\r\n", Signal{}, false, 0},
+	}
+	for _, c := range cases {
+		got, ok := ParseCSQ(c.raw)
+		if ok != c.ok || got != c.want || (ok && got.DBm() != c.dbm) {
+			t.Errorf("%q: got %#v %v %d, want %#v %v %d", c.raw, got, ok, got.DBm(), c.want, c.ok, c.dbm)
+		}
+	}
+}
+
+func TestParseCOPS(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want Operator
+		ok   bool
+	}{
+		{"AT+COPS?\r\r\n+COPS: 0,0,\"CHINA MOBILE\",7\r\n\r\nOK\r\n", Operator{Mode: 0, Format: 0, Name: "CHINA MOBILE", AcT: 7}, true},
+		{"\r\n+COPS: 0,0,\"CHINA MOBILE\"\r\n\r\nOK\r\n", Operator{Mode: 0, Format: 0, Name: "CHINA MOBILE", AcT: -1}, true},
+		{"\r\n+COPS: 0\r\n\r\nOK\r\n", Operator{Mode: 0, Format: -1, AcT: -1}, true},
+		{"\r\n+COPS: 0,2,\"46000\",7\r\n", Operator{Mode: 0, Format: 2, Name: "46000", AcT: 7}, true},
+		{"\r\n+CME ERROR: 10\r\n", Operator{}, false},
+	}
+	for _, c := range cases {
+		got, ok := ParseCOPS(c.raw)
+		if ok != c.ok || got != c.want {
+			t.Errorf("%q: got %#v %v, want %#v %v", c.raw, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestParseCREG(t *testing.T) {
+	raw := "AT+CREG?\r\r\n+CREG: 2,1,\"25F3\",\"0A1B2C3\",7\r\n\r\nOK\r\n" +
+		"\r\n+CEREG: 5\r\n" +
+		"\r\n+CREG: 1,\"25F3\",\"0A1B2C3\"\r\n"
+	want := []Registration{{LTE: false, Stat: 1}, {LTE: true, Stat: 5}, {LTE: false, Stat: 1}}
+	if got := ParseCREG(raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %#v\nwant %#v", got, want)
+	}
+}
+
+func TestParseCUSD(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want USSD
+		ok   bool
+	}{
+		{
+			"AT+CUSD=1,\"*100#\",15\r\r\nOK\r\n\r\n+CUSD: 0,\"Balance: 12.50, valid until 2024-12-31\",15\r\n",
+			USSD{Status: 0, Text: "Balance: 12.50, valid until 2024-12-31", DCS: 15}, true,
+		},
+		{"\r\n+CUSD: 1,\"4F59989D\",72\r\n", USSD{Status: 1, Text: "4F59989D", DCS: 72}, true},
+		{"\r\n+CUSD: 2\r\n", USSD{Status: 2, DCS: 15}, true},
+		{"\r\n+CUSD: 4\r\n", USSD{Status: 4, DCS: 15}, true},
+		{"AT+CUSD=1,\"*100#\",15\r\r\n+CME ERROR: 3\r\n", USSD{}, false},
+	}
+	for _, c := range cases {
+		got, ok := ParseCUSD(c.raw)
+		if ok != c.ok || got != c.want {
+			t.Errorf("%q: got %#v %v, want %#v %v", c.raw, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestParseCLIP(t *testing.T) {
+	got, ok := ParseCLIP("\r\nRING\r\n\r\n+CLIP: \"+8613700000000\",145,\"\",0,\"Zhang, San\",0\r\n")
+	want := CallerID{Number: "+8613700000000", Type: 145, Alpha: "Zhang, San"}
+	if !ok || got != want {
+		t.Errorf("got %#v %v, want %#v", got, ok, want)
+	}
+	got, ok = ParseCLIP("\r\nRING\r\n\r\n+CLIP: \"\",128\r\n")
+	want = CallerID{Number: "", Type: 128}
+	if !ok || got != want {
+		t.Errorf("withheld: got %#v %v, want %#v", got, ok, want)
+	}
+	if _, ok := ParseCLIP("\r\nRING\r\n"); ok {
+		t.Errorf("ring without clip should not match")
+	}
+}
+
+func TestParseRings(t *testing.T) {
+	cases := map[string]int{
+		"\r\nRING\r\n\r\n+CLIP: \"+8613700000000\",145,\"\",0,\"\",0\r\n\r\nRING\r\n": 2,
+		"\r\n+CRING: VOICE\r\n\r\n+CLIP: \"+8613700000000\",145\r\n":                  1,
+		"\r\n+CUSD: 0,\"SPRING offer\",15\r\n":                                        0,
+		"\r\n+CUSD: 0,\"offer:\r\nRINGTONE\",15\r\n":                                  0,
+		"\r\nCONNECT 6\r\n#!AMR\nRING\x00\r\n\r\n+QFDWL: 6,1a2b\r\n\r\nOK\r\n":        0,
+	}
+	for raw, want := range cases {
+		if got := ParseRings(raw); got != want {
+			t.Errorf("%q: got %d, want %d", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package atparse
+
+import (
+	"strings"
+)
+
+// 文本模式下的一条短信, Sender、Alpha和Body保持模块返回的原样(UCS2时为十六进制)
+type SMS struct {
+	Index  int
+	Status string
+	Sender string
+	Alpha  string
+	Time   string
+	Body   string
+}
+
+// 新消息提示, Kind为CMTI(新短信)或CDSI(存储的状态报告)
+type Indication struct {
+	Kind  string
+	Mem   string
+	Index int
+}
+
+// 短信状态报告, Ref为发送时+CMGS返回的编号, Status为GSM 03.40的TP-Status
+type StatusReport struct {
+	Ref       int
+	Recipient string
+	Submitted string
+	Done      string
+	Status    int
+}
+
+// 收集标题行之后到下一个标题行、主动上报或最终结果之前的内容作为正文, 保留正文中的空行
+// 只有最后一行才是最终结果, 正文中单独一行的OK或ERROR保留在正文中
+func collectBody(lines []string, start int, prefix string) (string, int) {
+	end := len(lines)
+	if last := finalIndex(lines); last >= 0 && isFinal(lines[last]) {
+		end = last
+	}
+	i := start
+	for ; i < end; i++ {
+		if _, ok := payload(lines[i], prefix); ok || isUnsolicited(lines[i]) {
+			break
+		}
+	}
+	body := strings.Trim(strings.Join(lines[start:i], "\n"), "\n")
+	return body, i
+}
+
+// +CMGL: <index>,<stat>,<oa>,[<alpha>],[<scts>]
+// EC20的alpha为空字段, SIM900A为空字符串, 时间中的逗号在引号内不影响拆分
+// 读取被截断时最后一条短信的正文可能不完整或为空
+func ParseCMGL(raw string) []SMS {
+	var msgs []SMS
+	lines := Lines(raw)
+	for i := 0; i < len(lines); {
+		p, ok := payload(lines[i], "+CMGL")
+		if !ok {
+			i++
+			continue
+		}
+		f := splitFields(p)
+		msg := SMS{
+			Index:  intField(f, 0, -1),
+			Status: strField(f, 1),
+			Sender: strField(f, 2),
+			Alpha:  strField(f, 3),
+			Time:   strField(f, 4),
+		}
+		msg.Body, i = collectBody(lines, i+1, "+CMGL")
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// +CMGR: <stat>,<oa>,[<alpha>],<scts> 后跟正文, 状态报告返回false, 请用ParseCDS
+func ParseCMGR(raw string) (SMS, bool) {
+	lines := Lines(raw)
+	for i, line := range lines {
+		p, ok := payload(line, "+CMGR")
+		if !ok {
+			continue
+		}
+		f := splitFields(p)
+		if len(f) > 1 && !f[1].quoted {
+			return SMS{}, false
+		}
+		msg := SMS{
+			Index:  -1,
+			Status: strField(f, 0),
+			Sender: strField(f, 1),
+			Alpha:  strField(f, 2),
+			Time:   strField(f, 3),
+		}
+		msg.Body, _ = collectBody(lines, i+1, "+CMGR")
+		return msg, true
+	}
+	return SMS{}, false
+}
+
+// +CMTI: <mem>,<index> 和 +CDSI: <mem>,<index>
+func ParseIndications(raw string) []Indication {
+	var inds []Indication
+	for _, line := range Lines(raw) {
+		for _, kind := range []string{"CMTI", "CDSI"} {
+			p, ok := payload(line, "+"+kind)
+			if !ok {
+				continue
+			}
+			f := splitFields(p)
+			if idx := intField(f, 1, -1); idx >= 0 {
+				inds = append(inds, Indication{Kind: kind, Mem: strField(f, 0), Index: idx})
+			}
+		}
+	}
+	return inds
+}
+
+// +CDS: <fo>,<mr>,<ra>,<tora>,<scts>,<dt>,<st>
+// 用CMGR读取时前面多一个状态字段: +CMGR: <stat>,<fo>,<mr>,...
+func ParseCDS(raw string) []StatusReport {
+	var reports []StatusReport
+	for _, line := range Lines(raw) {
+		f, ok := []field(nil), false
+		if p, found := payload(line, "+CDS"); found {
+			f, ok = splitFields(p), true
+		} else if p, found := payload(line, "+CMGR"); found {
+			f = splitFields(p)
+			//普通短信的第二个字段是号码, 状态报告是数字
+			if len(f) > 1 && !f[1].quoted {
+				f, ok = f[1:], true
+			}
+		}
+		if !ok || len(f) < 7 {
+			continue
+		}
+		report := StatusReport{
+			Ref:       intField(f, 1, -1),
+			Recipient: strField(f, 2),
+			Submitted: strField(f, 4),
+			Done:      strField(f, 5),
+			Status:    intField(f, 6, -1),
+		}
+		if report.Ref < 0 || report.Status < 0 {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// +CMGS: <mr>, 没有时返回-1
+func ParseCMGS(raw string) int {
+	for _, line := range Lines(raw) {
+		if p, ok := payload(line, "+CMGS"); ok {
+			return intField(splitFields(p), 0, -1)
+		}
+	}
+	return -1
+}
@@ -0,0 +1,183 @@
+package atparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCMGL(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want []SMS
+	}{
+		{
+			name: "ec20 empty alpha",
+			raw: "AT+CMGL=\"REC UNREAD\"\r\r\n" +
+				"+CMGL: 1,\"REC UNREAD\",\"+8613800000000\",,\"24/10/19,08:30:12+32\"\r\n" +
+				"Hello, world\r\n" +
+				"+CMGL: 2,\"REC UNREAD\",\"10086\",,\"24/10/19,08:31:00+32\"\r\n" +
+				"Balance: 12.50, due 10/30\r\n" +
+				"\r\nOK\r\n",
+			want: []SMS{
+				{Index: 1, Status: "REC UNREAD", Sender: "+8613800000000", Time: "24/10/19,08:30:12+32", Body: "Hello, world"},
+				{Index: 2, Status: "REC UNREAD", Sender: "10086", Time: "24/10/19,08:31:00+32", Body: "Balance: 12.50, due 10/30"},
+			},
+		},
+		{
+			name: "sim900a empty string alpha and blank lines in body",
+			raw: "\r\n+CMGL: 3,\"REC UNREAD\",\"+8613900000000\",\"\",\"24/10/19,09:00:00+32\"\r\n" +
+				"line one\r\n\r\nline three, with comma\r\n" +
+				"\r\nOK\r\n\x00\x00",
+			want: []SMS{
+				{Index: 3, Status: "REC UNREAD", Sender: "+8613900000000", Time: "24/10/19,09:00:00+32", Body: "line one\n\nline three, with comma"},
+			},
+		},
+		{
+			name: "ucs2 hex sender and body",
+			raw: "\r\n+CMGL: 5,\"REC UNREAD\",\"002B0038003600310030003000380036\",,\"24/10/19,09:20:00+32\"\r\n" +
+				"4F60597D\r\n\r\nOK\r\n",
+			want: []SMS{
+				{Index: 5, Status: "REC UNREAD", Sender: "002B0038003600310030003000380036", Time: "24/10/19,09:20:00+32", Body: "4F60597D"},
+			},
+		},
+		{
+			name: "truncated body",
+			raw: "\r\n+CMGL: 6,\"REC UNREAD\",\"10086\",,\"24/10/19,09:30:00+32\"\r\n" +
+				"Your balance is",
+			want: []SMS{
+				{Index: 6, Status: "REC UNREAD", Sender: "10086", Time: "24/10/19,09:30:00+32", Body: "Your balance is"},
+			},
+		},
+		{
+			name: "truncated header",
+			raw:  "\r\n+CMGL: 7,\"REC UNR",
+			want: []SMS{
+				{Index: 7, Status: "REC UNR"},
+			},
+		},
+		{
+			name: "unsolicited lines between messages",
+			raw: "\r\n+CMGL: 8,\"REC UNREAD\",\"+8613800000000\",,\"24/10/19,10:00:00+32\"\r\n" +
+				"first\r\n" +
+				"\r\n+CDS: 6,46,\"+8613900000000\",145,\"24/10/19,09:59:50+32\",\"24/10/19,09:59:55+32\",0\r\n" +
+				"\r\n+CMTI: \"SM\",9\r\n" +
+				"\r\nRING\r\n" +
+				"\r\n+CLIP: \"+8613700000000\",145,\"\",0,\"\",0\r\n" +
+				"+CMGL: 9,\"REC UNREAD\",\"+8613800000000\",,\"24/10/19,10:00:05+32\"\r\n" +
+				"second\r\n\r\nOK\r\n",
+			want: []SMS{
+				{Index: 8, Status: "REC UNREAD", Sender: "+8613800000000", Time: "24/10/19,10:00:00+32", Body: "first"},
+				{Index: 9, Status: "REC UNREAD", Sender: "+8613800000000", Time: "24/10/19,10:00:05+32", Body: "second"},
+			},
+		},
+		{
+			name: "empty list",
+			raw:  "AT+CMGL=\"REC UNREAD\"\r\r\nOK\r\n",
+			want: nil,
+		},
+		{
+			name: "cms error",
+			raw:  "\r\n+CMS ERROR: 310\r\n",
+			want: nil,
+		},
+	}
+	for _, c := range cases {
+		if got := ParseCMGL(c.raw); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\ngot  %#v\nwant %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseCMGR(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want SMS
+		ok   bool
+	}{
+		{
+			name: "ec20",
+			raw: "AT+CMGR=3\r\r\n+CMGR: \"REC READ\",\"+8613800000000\",,\"24/10/19,08:30:12+32\"\r\n" +
+				"Meet at 5, room 2\r\n\r\nsee you\r\n\r\nOK\r\n",
+			want: SMS{Index: -1, Status: "REC READ", Sender: "+8613800000000", Time: "24/10/19,08:30:12+32", Body: "Meet at 5, room 2\n\nsee you"},
+			ok:   true,
+		},
+		{
+			name: "sim900a",
+			raw: "\r\n+CMGR: \"REC UNREAD\",\"10086\",\"\",\"24/10/19,08:31:00+32\"\r\n" +
+				"Balance: 12.50\r\n\r\nOK\r\n",
+			want: SMS{Index: -1, Status: "REC UNREAD", Sender: "10086", Time: "24/10/19,08:31:00+32", Body: "Balance: 12.50"},
+			ok:   true,
+		},
+		{
+			name: "ring after body",
+			raw: "\r\n+CMGR: \"REC UNREAD\",\"10086\",,\"24/10/19,08:31:00+32\"\r\n" +
+				"hello\r\n\r\nRING\r\n\r\nOK\r\n",
+			want: SMS{Index: -1, Status: "REC UNREAD", Sender: "10086", Time: "24/10/19,08:31:00+32", Body: "hello"},
+			ok:   true,
+		},
+		{
+			name: "error line in body",
+			raw: "\r\n+CMGR: \"REC UNREAD\",\"10086\",,\"24/10/19,08:31:00+32\"\r\n" +
+				"result:\r\nERROR\r\n\r\nOK\r\n",
+			want: SMS{Index: -1, Status: "REC UNREAD", Sender: "10086", Time: "24/10/19,08:31:00+32", Body: "result:\nERROR"},
+			ok:   true,
+		},
+		{
+			name: "status report",
+			raw:  "\r\n+CMGR: \"REC UNREAD\",6,47,\"+8613900000000\",145,\"24/10/19,10:00:00+32\",\"24/10/19,10:00:09+32\",0\r\n\r\nOK\r\n",
+			ok:   false,
+		},
+		{
+			name: "empty index",
+			raw:  "AT+CMGR=9\r\r\nOK\r\n",
+			ok:   false,
+		},
+		{
+			name: "cms error",
+			raw:  "AT+CMGR=99\r\r\n+CMS ERROR: 321\r\n",
+			ok:   false,
+		},
+	}
+	for _, c := range cases {
+		got, ok := ParseCMGR(c.raw)
+		if ok != c.ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\ngot  %#v %v\nwant %#v %v", c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestParseCDS(t *testing.T) {
+	raw := "\r\n+CDS: 6,46,\"+8613900000000\",145,\"24/10/19,09:59:50+32\",\"24/10/19,09:59:55+32\",0\r\n" +
+		"AT+CMGR=2\r\r\n+CMGR: \"REC UNREAD\",6,47,\"+8613900000000\",145,\"24/10/19,10:00:00+32\",\"24/10/19,10:00:09+32\",70\r\n\r\nOK\r\n" +
+		"\r\n+CMGR: \"REC READ\",\"+8613800000000\",,\"24/10/19,10:00:00+32\"\r\n1,2,3,4,5,6,7\r\n\r\nOK\r\n"
+	want := []StatusReport{
+		{Ref: 46, Recipient: "+8613900000000", Submitted: "24/10/19,09:59:50+32", Done: "24/10/19,09:59:55+32", Status: 0},
+		{Ref: 47, Recipient: "+8613900000000", Submitted: "24/10/19,10:00:00+32", Done: "24/10/19,10:00:09+32", Status: 70},
+	}
+	if got := ParseCDS(raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %#v\nwant %#v", got, want)
+	}
+}
+
+func TestParseIndications(t *testing.T) {
+	raw := "\r\n+CMTI: \"SM\",3\r\n\r\n+CDSI: \"SR\",1\r\n\r\n+CMTI: \"ME\",\r\n"
+	want := []Indication{{Kind: "CMTI", Mem: "SM", Index: 3}, {Kind: "CDSI", Mem: "SR", Index: 1}}
+	if got := ParseIndications(raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %#v\nwant %#v", got, want)
+	}
+}
+
+func TestParseCMGS(t *testing.T) {
+	cases := map[string]int{
+		"AT+CMGS=\"10086\"\r\r\n> CXYE\x1a\r\n+CMGS: 123\r\n\r\nOK\r\n": 123,
+		"\r\n+CMS ERROR: 500\r\n": -1,
+		"> CXYE":                  -1,
+	}
+	for raw, want := range cases {
+		if got := ParseCMGS(raw); got != want {
+			t.Errorf("%q: got %d, want %d", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	AUDIO_AMR              string = "amr"
+	AUDIO_AMR_WB           string = "amr-wb"
+	AUDIO_SPEEX            string = "speex"
+	AUDIO_OPUS             string = "opus"
+	AUDIO_MP3              string = "mp3"
+	AUDIO_WAV              string = "wav"
+	DEFAULT_FFMPEG_TIMEOUT uint   = 30
+)
+
+// 交给语音识别的音频, Rate为采样率, 未知时为0
+type Audio struct {
+	Data   []byte
+	Format string
+	Rate   int
+}
+
+// 按文件头识别容器格式, 识别不出时返回空
+func DetectAudioFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("#!AMR-WB\n")):
+		return AUDIO_AMR_WB
+	case bytes.HasPrefix(data, []byte("#!AMR\n")):
+		return AUDIO_AMR
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE")):
+		return AUDIO_WAV
+	case bytes.HasPrefix(data, []byte("OggS")):
+		//Ogg的第一页中是编码的标识头
+		head := data
+		if len(head) > 64 {
+			head = head[:64]
+		}
+		if bytes.Contains(head, []byte("Speex   ")) {
+			return AUDIO_SPEEX
+		}
+		if bytes.Contains(head, []byte("OpusHead")) {
+			return AUDIO_OPUS
+		}
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return AUDIO_MP3
+	case len(data) >= 2 && data[0] == 0xff && data[1]&0xe0 == 0xe0:
+		return AUDIO_MP3
+	}
+	return ""
+}
+
+// 语音识别前的转码: 有ffmpeg时把各种格式转为单声道16位的WAV, 否则只能处理WAV的声道合并和重采样, 其他格式原样交给识别后端
+type AudioPipeline struct {
+	FFmpeg  string
+	Rate    int
+	Timeout time.Duration
+}
+
+func NewAudioPipeline(config Config) *AudioPipeline {
+	rate := config.SpeechRate
+	if rate == 0 {
+		rate = DEFAULT_SPEECH_RATE
+	}
+	timeout := config.FFmpegTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_FFMPEG_TIMEOUT
+	}
+	return &AudioPipeline{FFmpeg: config.FFmpeg, Rate: rate, Timeout: time.Duration(timeout) * time.Second}
+}
+
+// hint为消息中标明的格式, 文件头识别不出时使用
+func (p *AudioPipeline) Convert(data []byte, hint string) (Audio, error) {
+	format := DetectAudioFormat(data)
+	if len(format) == 0 {
+		format = hint
+	}
+	if len(p.FFmpeg) > 0 {
+		out, err := p.ffmpeg(data, format)
+		if err != nil {
+			return Audio{}, err
+		}
+		return Audio{Data: out, Format: AUDIO_WAV, Rate: p.Rate}, nil
+	}
+	switch format {
+	case AUDIO_WAV:
+		out, err := ResampleWAV(data, p.Rate)
+		if err != nil {
+			return Audio{}, err
+		}
+		return Audio{Data: out, Format: AUDIO_WAV, Rate: p.Rate}, nil
+	case AUDIO_AMR:
+		return Audio{Data: data, Format: AUDIO_AMR, Rate: 8000}, nil
+	case AUDIO_AMR_WB:
+		return Audio{Data: data, Format: AUDIO_AMR_WB, Rate: 16000}, nil
+	}
+	return Audio{Data: data, Format: format}, nil
+}
+
+func (p *AudioPipeline) ffmpeg(data []byte, format string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	//AMR-WB和Speex从管道读取时不一定能自动识别
+	switch format {
+	case AUDIO_AMR, AUDIO_AMR_WB:
+		args = append(args, "-f", "amr")
+	case AUDIO_SPEEX, AUDIO_OPUS:
+		args = append(args, "-f", "ogg")
+	}
+	args = append(args, "-i", "pipe:0", "-ac", "1", "-ar", strconv.Itoa(p.Rate), "-acodec", "pcm_s16le", "-f", "wav", "pipe:1")
+	cmd := exec.CommandContext(ctx, p.FFmpeg, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ffmpeg转码超时(%s)", p.Timeout)
+		}
+		return nil, fmt.Errorf("ffmpeg转码%s失败: %v %s", format, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	//ffmpeg写管道时无法回填RIFF和data的长度, 按实际长度重新生成文件头
+	samples, rate, err := decodeWAV(stdout.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return encodeWAV(samples, rate), nil
+}
+
+// 把16位PCM的WAV合并为单声道并线性插值重采样到rate
+func ResampleWAV(data []byte, rate int) ([]byte, error) {
+	samples, srcRate, err := decodeWAV(data)
+	if err != nil {
+		return nil, err
+	}
+	if srcRate == rate {
+		return encodeWAV(samples, rate), nil
+	}
+	n := int(int64(len(samples)) * int64(rate) / int64(srcRate))
+	out := make([]int16, n)
+	for i := range out {
+		pos := float64(i) * float64(srcRate) / float64(rate)
+		j := int(pos)
+		frac := pos - float64(j)
+		a := float64(samples[j])
+		b := a
+		if j+1 < len(samples) {
+			b = float64(samples[j+1])
+		}
+		out[i] = int16(a + (b-a)*frac)
+	}
+	return encodeWAV(out, rate), nil
+}
+
+// 返回合并为单声道的采样, 只支持16位PCM; data块的长度不可信时读到文件末尾
+func decodeWAV(data []byte) ([]int16, int, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, errors.New("不是WAV文件")
+	}
+	var channels, bits int
+	var rate int
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		sz := binary.LittleEndian.Uint32(data[pos+4 : pos+8])
+		body := data[pos+8:]
+		//ffmpeg输出到管道时data的长度为0或0xFFFFFFFF
+		size := len(body)
+		if uint64(sz) < uint64(len(body)) && !(id == "data" && sz == 0) {
+			size = int(sz)
+			body = body[:size]
+		}
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, errors.New("WAV文件头不完整")
+			}
+			if binary.LittleEndian.Uint16(body[0:2]) != 1 {
+				return nil, 0, errors.New("只支持PCM编码的WAV")
+			}
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			rate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+		case "data":
+			if channels == 0 || rate == 0 {
+				return nil, 0, errors.New("WAV文件缺少fmt块")
+			}
+			if bits != 16 {
+				return nil, 0, fmt.Errorf("只支持16位的WAV, 当前为%d位", bits)
+			}
+			frames := len(body) / 2 / channels
+			samples := make([]int16, frames)
+			for i := 0; i < frames; i++ {
+				sum := 0
+				for c := 0; c < channels; c++ {
+					off := (i*channels + c) * 2
+					sum += int(int16(binary.LittleEndian.Uint16(body[off : off+2])))
+				}
+				samples[i] = int16(sum / channels)
+			}
+			return samples, rate, nil
+		}
+		pos += 8 + size + size%2
+	}
+	return nil, 0, errors.New("WAV文件缺少data块")
+}
+
+func encodeWAV(samples []int16, rate int) []byte {
+	var buf bytes.Buffer
+	size := len(samples) * 2
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+size))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))
+	binary.Write(&buf, binary.LittleEndian, uint32(rate))
+	binary.Write(&buf, binary.LittleEndian, uint32(rate*2))
+	binary.Write(&buf, binary.LittleEndian, uint16(2))
+	binary.Write(&buf, binary.LittleEndian, uint16(16))
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(size))
+	binary.Write(&buf, binary.LittleEndian, samples)
+	return buf.Bytes()
+}
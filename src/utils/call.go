@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"utils/atparse"
+)
+
+const (
+	CMD_CLCC  string = "AT+CLCC"   //当前通话列表
+	CMD_QTTS  string = "AT+QTTS="  //EC20 内置TTS, 1表示文本为UCS2编码, 通话中播放时对方可以听到
+	CMD_QPCMV string = "AT+QPCMV=" //EC20 通过USB口收发通话的PCM数据(8k 16位单声道)
+
+	SAY_QTTS string = "qtts"
+	SAY_PCM  string = "pcm"
+
+	DEFAULT_SAY_REPEAT         int           = 2
+	DEFAULT_SAY_ANSWER_TIMEOUT uint          = 60
+	CALL_POLL_INTERVAL         time.Duration = 2 * time.Second
+	CALL_EXEC_TIMEOUT          time.Duration = 30 * time.Second
+	TTS_CHAR_DURATION          time.Duration = 300 * time.Millisecond //估算内置TTS的播放时长
+	PCM_RATE                   int           = 8000
+	PCM_FRAME                  int           = 320 //20ms
+)
+
+func (m *Modem) execCmd(cmd string) (string, error) {
+	result, err := m.Exec(PhoneMsg{CmdDelay: 1, ATCmd: []byte(cmd + CMD_LF_CR)}, CALL_EXEC_TIMEOUT)
+	if err != nil {
+		return "", err
+	}
+	if e := atparse.ParseError(result.Result); e != nil {
+		return result.Result, errors.New(e.Error())
+	}
+	return result.Result, nil
+}
+
+// 本模块呼出的语音通话, 已经结束时ok为false
+func outgoingCall(result string) (atparse.Call, bool) {
+	for _, call := range atparse.ParseCLCC(result) {
+		if call.Dir == 0 && call.Mode == 0 {
+			return call, true
+		}
+	}
+	return atparse.Call{}, false
+}
+
+// 还有接通或正在建立的语音通话, 不区分呼入呼出
+func voiceCall(result string) bool {
+	for _, call := range atparse.ParseCLCC(result) {
+		if call.Mode == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 通话结束的上报可能被其他指令读走, 读不到时只能给出笼统的原因
+func callEndReason(result string) string {
+	switch {
+	case strings.Contains(result, "BUSY"):
+		return "对方忙"
+	case strings.Contains(result, "NO ANSWER"):
+		return "无人接听"
+	case strings.Contains(result, "NO DIALTONE"):
+		return "没有拨号音, 请检查网络"
+	}
+	return "未接通(对方拒接、忙或无法接通)"
+}
+
+// 拨号后给对方播放text, 接通、振铃等进度通过progress通知, 返回通话结果
+func SayCall(modem *Modem, phone string, text string, progress func(msg string)) string {
+	config := modem.Config
+	if config.Dialect == DIALECT_SIM900A {
+		return "SIM900A 不支持通话中播放语音"
+	}
+	var pcm []byte
+	if config.SayMode == SAY_PCM {
+		//先合成再拨号, 避免对方接听后等待
+		var err error
+		if pcm, err = synthesizePCM(config, text); err != nil {
+			return "语音合成失败: " + err.Error()
+		}
+	} else if len(config.SayMode) > 0 && config.SayMode != SAY_QTTS {
+		return fmt.Sprintf("未知的saymode: %s, 可选: %s, %s", config.SayMode, SAY_QTTS, SAY_PCM)
+	}
+	if result, err := modem.execCmd(CMD_CLCC); err == nil && len(atparse.ParseCLCC(result)) > 0 {
+		return "模块正在通话中, 请稍后再试"
+	}
+	if _, err := modem.execCmd(CMD_ATD + phone + ";"); err != nil {
+		return "拨号失败: " + err.Error()
+	}
+	progress("正在呼叫 " + phone)
+
+	timeout := config.SayAnswerTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_SAY_ANSWER_TIMEOUT
+	}
+	if reason, ok := waitAnswer(modem, time.Duration(timeout)*time.Second, progress); !ok {
+		modem.execCmd(CMD_ATH)
+		return phone + " " + reason
+	}
+	progress("对方已接听, 开始播放")
+
+	repeat := config.SayRepeat
+	if repeat == 0 {
+		repeat = DEFAULT_SAY_REPEAT
+	}
+	for i := 0; i < repeat; i++ {
+		var alive bool
+		var err error
+		if config.SayMode == SAY_PCM {
+			alive, err = playPCM(modem, pcm)
+		} else {
+			alive, err = playTTS(modem, text)
+		}
+		if err != nil {
+			modem.execCmd(CMD_ATH)
+			return "播放失败, 已挂断: " + err.Error()
+		}
+		if !alive {
+			return fmt.Sprintf("对方在第%d遍播放时挂断", i+1)
+		}
+	}
+	modem.execCmd(CMD_ATH)
+	return fmt.Sprintf("已给 %s 播放%d遍, 已挂断", phone, repeat)
+}
+
+func waitAnswer(modem *Modem, timeout time.Duration, progress func(msg string)) (string, bool) {
+	deadline := time.Now().Add(timeout)
+	alerting := false
+	for time.Now().Before(deadline) {
+		time.Sleep(CALL_POLL_INTERVAL)
+		result, err := modem.execCmd(CMD_CLCC)
+		if err != nil {
+			return "查询通话状态失败: " + err.Error(), false
+		}
+		call, ok := outgoingCall(result)
+		if !ok {
+			return callEndReason(result), false
+		}
+		switch call.Stat {
+		case 0:
+			return "", true
+		case 3:
+			if !alerting {
+				progress("对方振铃中")
+				alerting = true
+			}
+		}
+	}
+	return fmt.Sprintf("无人接听(%d秒)", int(timeout.Seconds())), false
+}
+
+// 播放期间轮询通话状态, 对方挂断时alive为false
+func playTTS(modem *Modem, text string) (alive bool, err error) {
+	ucs2, err := Utf8ToUcs2(text)
+	if err != nil {
+		return true, err
+	}
+	if _, err := modem.execCmd(CMD_QTTS + "1,\"" + ucs2 + "\""); err != nil {
+		return true, err
+	}
+	//播放结束时模块上报+QTTS: 0, 上报被其他指令读走时按字数估算的时长等待
+	deadline := time.Now().Add(time.Duration(len([]rune(text)))*TTS_CHAR_DURATION + time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(CALL_POLL_INTERVAL)
+		result, err := modem.execCmd(CMD_CLCC)
+		if err != nil {
+			return true, err
+		}
+		if !voiceCall(result) {
+			return false, nil
+		}
+		if strings.Contains(result, "+QTTS: 0") {
+			break
+		}
+	}
+	return true, nil
+}
+
+// 按实际时长写入PCM数据, 查询通话状态需要一秒多, 放在单独的goroutine中以免声音断续
+func playPCM(modem *Modem, pcm []byte) (alive bool, err error) {
+	device := modem.Config.SayAudioDevice
+	if len(device) == 0 {
+		return true, errors.New("saymode为pcm时需要配置sayaudiodevice")
+	}
+	if _, err := modem.execCmd(CMD_QPCMV + "1,0"); err != nil {
+		return true, err
+	}
+	defer modem.execCmd(CMD_QPCMV + "0")
+	port, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return true, err
+	}
+	defer port.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	hungup := watchCall(modem, stop)
+	frameTime := time.Duration(PCM_FRAME/2) * time.Second / time.Duration(PCM_RATE)
+	ticker := time.NewTicker(frameTime)
+	defer ticker.Stop()
+	for off := 0; off < len(pcm); off += PCM_FRAME {
+		end := off + PCM_FRAME
+		if end > len(pcm) {
+			end = len(pcm)
+		}
+		if _, err := port.Write(pcm[off:end]); err != nil {
+			return true, err
+		}
+		select {
+		case <-hungup:
+			return false, nil
+		case <-ticker.C:
+		}
+	}
+	return true, nil
+}
+
+// 通话结束时关闭返回的channel
+func watchCall(modem *Modem, stop chan struct{}) chan struct{} {
+	hungup := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(CALL_POLL_INTERVAL):
+			}
+			result, err := modem.execCmd(CMD_CLCC)
+			if err != nil {
+				continue
+			}
+			if !voiceCall(result) {
+				close(hungup)
+				return
+			}
+		}
+	}()
+	return hungup
+}
+
+// 执行saycommand合成语音, 输出为WAV, 转为模块需要的8k 16位单声道PCM
+func synthesizePCM(config Config, text string) ([]byte, error) {
+	if len(config.SayCommand) == 0 {
+		return nil, errors.New("saymode为pcm时需要配置saycommand")
+	}
+	args := make([]string, len(config.SayCommand))
+	for i, arg := range config.SayCommand {
+		args[i] = strings.ReplaceAll(arg, "{text}", text)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CALL_EXEC_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("合成超时(%s)", CALL_EXEC_TIMEOUT)
+		}
+		return nil, fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	wav, err := ResampleWAV(out, PCM_RATE)
+	if err != nil {
+		return nil, err
+	}
+	//ResampleWAV输出固定44字节的文件头
+	return wav[44:], nil
+}
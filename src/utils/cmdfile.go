@@ -0,0 +1,456 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const DEFAULT_HTTP_TIMEOUT uint = 10
+
+// 占位符只能是字母、数字和下划线, 请求体中的JSON如 {"on":1} 不会被当作占位符
+var placeholderRgx = regexp.MustCompile(`\{([\p{L}\p{N}_]+)\}`)
+
+// 扩展指令文件中的一条指令, url/headers/body中的{name}会被替换为对应的参数
+type CmdDef struct {
+	Method   string            `json:"method"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	Params   []ScriptParam     `json:"params"`
+	Timeout  uint              `json:"timeout"`
+	JSONPath map[string]string `json:"jsonpath"`
+	Regex    map[string]string `json:"regex"`
+	Reply    string            `json:"reply"`
+	Aliases  []string          `json:"aliases"`
+	Role     string            `json:"role"`
+	Help     string            `json:"help"`
+
+	name    string
+	regexes map[string]*regexp.Regexp
+	params  []*regexp.Regexp
+	reply   *template.Template
+}
+
+func (def *CmdDef) Name() string {
+	return def.name
+}
+
+func (def *CmdDef) compile(name string) error {
+	def.name = name
+	def.Method = strings.ToUpper(def.Method)
+	if len(def.Method) == 0 {
+		def.Method = "GET"
+	}
+	switch def.Method {
+	case "GET", "POST", "PUT", "DELETE", "PATCH", "HEAD":
+	default:
+		return fmt.Errorf("%s: 不支持的method %s", name, def.Method)
+	}
+	if !strings.HasPrefix(def.URL, "http://") && !strings.HasPrefix(def.URL, "https://") {
+		return fmt.Errorf("%s: url必须以http://或https://开头", name)
+	}
+	known := make(map[string]bool)
+	for _, p := range def.Params {
+		if len(p.Name) == 0 {
+			return fmt.Errorf("%s: 参数缺少name", name)
+		}
+		known[p.Name] = true
+		var rgx *regexp.Regexp
+		if len(p.Pattern) > 0 {
+			var err error
+			if rgx, err = regexp.Compile(p.Pattern); err != nil {
+				return fmt.Errorf("%s: 参数 %s 的pattern有误: %v", name, p.Name, err)
+			}
+		}
+		def.params = append(def.params, rgx)
+	}
+	templates := []string{def.URL, def.Body}
+	for _, v := range def.Headers {
+		templates = append(templates, v)
+	}
+	for _, t := range templates {
+		for _, m := range placeholderRgx.FindAllStringSubmatch(t, -1) {
+			if !known[m[1]] {
+				return fmt.Errorf("%s: 占位符 {%s} 没有对应的参数", name, m[1])
+			}
+		}
+	}
+	def.regexes = make(map[string]*regexp.Regexp)
+	for k, v := range def.Regex {
+		rgx, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("%s: regex %s 有误: %v", name, k, err)
+		}
+		def.regexes[k] = rgx
+	}
+	for k, v := range def.JSONPath {
+		if !strings.HasPrefix(v, "$") {
+			return fmt.Errorf("%s: jsonpath %s 必须以$开头", name, k)
+		}
+	}
+	if len(def.Reply) > 0 {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(def.Reply)
+		if err != nil {
+			return fmt.Errorf("%s: reply模板有误: %v", name, err)
+		}
+		def.reply = tmpl
+	}
+	return nil
+}
+
+func (def *CmdDef) Usage() string {
+	usage := def.name
+	for _, p := range def.Params {
+		if p.Optional {
+			usage += CMD_SEP + "[" + p.Name + "]"
+		} else {
+			usage += CMD_SEP + "<" + p.Name + ">"
+		}
+	}
+	return usage
+}
+
+func (def *CmdDef) fill(tmpl string, params map[string]string, escape func(string) string) string {
+	return placeholderRgx.ReplaceAllStringFunc(tmpl, func(m string) string {
+		return escape(params[m[1:len(m)-1]])
+	})
+}
+
+// 校验参数, 发送请求并按jsonpath/regex提取结果, 有reply模板时按模板生成回复
+func (def *CmdDef) Execute(values []string) (string, error) {
+	if len(values) > len(def.Params) {
+		return "", fmt.Errorf("%s 参数过多, 用法: %s", def.name, def.Usage())
+	}
+	params := make(map[string]string)
+	for i, p := range def.Params {
+		if i >= len(values) || len(strings.TrimSpace(values[i])) == 0 {
+			if !p.Optional {
+				return "", fmt.Errorf("缺少参数 %s, 用法: %s", p.Name, def.Usage())
+			}
+			params[p.Name] = ""
+			continue
+		}
+		value := strings.TrimSpace(values[i])
+		if def.params[i] != nil && !def.params[i].MatchString(value) {
+			return "", fmt.Errorf("参数 %s 不合法: %s, 用法: %s", p.Name, value, def.Usage())
+		}
+		params[p.Name] = value
+	}
+
+	target := def.fill(def.URL, params, urlEscape)
+	body := def.fill(def.Body, params, def.bodyEscape())
+	req, err := http.NewRequest(def.Method, target, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for k, v := range def.Headers {
+		req.Header.Set(k, def.fill(v, params, func(s string) string { return s }))
+	}
+	timeout := def.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_HTTP_TIMEOUT
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	resp_body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("%s 请求失败: %s", def.name, resp.Status)
+	}
+	if len(def.JSONPath) == 0 && len(def.regexes) == 0 && def.reply == nil {
+		return string(resp_body), nil
+	}
+
+	vars := map[string]interface{}{"body": string(resp_body), "status": resp.StatusCode}
+	for k, v := range params {
+		vars[k] = v
+	}
+	if len(def.JSONPath) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(resp_body, &doc); err != nil {
+			return "", fmt.Errorf("%s 返回的不是JSON: %v", def.name, err)
+		}
+		for k, path := range def.JSONPath {
+			value, err := JSONPath(doc, path)
+			if err != nil {
+				return "", fmt.Errorf("%s 提取 %s 失败: %v", def.name, k, err)
+			}
+			vars[k] = value
+		}
+	}
+	for k, rgx := range def.regexes {
+		m := rgx.FindStringSubmatch(string(resp_body))
+		if m == nil {
+			return "", fmt.Errorf("%s 提取 %s 失败: 没有匹配", def.name, k)
+		}
+		vars[k] = m[len(m)-1]
+	}
+	if def.reply == nil {
+		var keys []string
+		for k := range def.JSONPath {
+			keys = append(keys, k)
+		}
+		for k := range def.regexes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var lines []string
+		for _, k := range keys {
+			lines = append(lines, fmt.Sprintf("%s: %v", k, vars[k]))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+	var out bytes.Buffer
+	if err := def.reply.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// body为JSON时参数按JSON字符串转义, 参数中的引号不会破坏或注入字段
+func (def *CmdDef) bodyEscape() func(string) string {
+	body := strings.TrimSpace(def.Body)
+	isJSON := strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[")
+	for k, v := range def.Headers {
+		if strings.EqualFold(k, "Content-Type") && strings.Contains(strings.ToLower(v), "json") {
+			isJSON = true
+		}
+	}
+	if !isJSON {
+		return func(s string) string { return s }
+	}
+	return jsonEscape
+}
+
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+func urlEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// 支持 $.a.b[0].c 形式的JSONPath子集
+func JSONPath(doc interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(path, "$")
+	cur := doc
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			key := path[:end]
+			path = path[end:]
+			obj, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s 不是对象", key)
+			}
+			if cur, ok = obj[key]; !ok {
+				return nil, fmt.Errorf("没有字段 %s", key)
+			}
+		case '[':
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("缺少 ]")
+			}
+			key := strings.Trim(path[1:end], "'\"")
+			path = path[end+1:]
+			if idx, err := strconv.Atoi(key); err == nil {
+				arr, ok := cur.([]interface{})
+				if !ok || idx < 0 || idx >= len(arr) {
+					return nil, fmt.Errorf("下标 %d 越界", idx)
+				}
+				cur = arr[idx]
+			} else {
+				obj, ok := cur.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s 不是对象", key)
+				}
+				if cur, ok = obj[key]; !ok {
+					return nil, fmt.Errorf("没有字段 %s", key)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("无法解析 %s", path)
+		}
+	}
+	return cur, nil
+}
+
+// 解析扩展指令文件, JSON格式之外兼容旧的"指令::URL"每行一条的格式
+// reserved不为空时, 与其返回true的名称(内置指令)重名的指令或别名会导致加载失败, 避免覆盖内置指令的权限和确认
+func ParseCmdFile(body []byte, reserved func(name string) bool) (map[string]*CmdDef, error) {
+	defs := make(map[string]*CmdDef)
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &defs); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, line := range strings.Split(string(body[:]), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.Contains(line, CMD_SEP) && !strings.HasPrefix(line, "#") {
+				str_array := strings.SplitN(line, CMD_SEP, 2)
+				if strings.HasPrefix(str_array[1], "http://") || strings.HasPrefix(str_array[1], "https://") {
+					defs[str_array[0]] = &CmdDef{URL: str_array[1]}
+				}
+			}
+		}
+	}
+	result := make(map[string]*CmdDef)
+	for name, def := range defs {
+		if def == nil {
+			return nil, fmt.Errorf("%s: 指令定义为空", name)
+		}
+		if reserved != nil && reserved(name) {
+			return nil, fmt.Errorf("%s: 与内置指令重名", name)
+		}
+		if err := def.compile(name); err != nil {
+			return nil, err
+		}
+		result[name] = def
+	}
+	for name, def := range defs {
+		for _, alias := range def.Aliases {
+			if _, ok := result[alias]; ok {
+				return nil, fmt.Errorf("%s: 别名 %s 与其他指令重复", name, alias)
+			}
+			if reserved != nil && reserved(alias) {
+				return nil, fmt.Errorf("%s: 别名 %s 与内置指令重名", name, alias)
+			}
+			result[alias] = def
+		}
+	}
+	return result, nil
+}
+
+// 扩展指令文件只在启动和文件变化时加载, 加载失败时保留上一次成功加载的指令
+type CmdFile struct {
+	mu       sync.RWMutex
+	path     string
+	reserved func(name string) bool
+	defs     map[string]*CmdDef
+	modTime  time.Time
+	size     int64
+}
+
+func NewCmdFile(path string, reserved func(name string) bool) (*CmdFile, error) {
+	f := &CmdFile{path: path, reserved: reserved, defs: make(map[string]*CmdDef)}
+	if len(path) == 0 {
+		return f, nil
+	}
+	_, err := f.Reload()
+	return f, err
+}
+
+// 返回true表示文件有变化并且重新加载成功
+func (f *CmdFile) Reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.mu.RLock()
+	changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+	f.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	body, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	defs, err := ParseCmdFile(body, f.reserved)
+	f.mu.Lock()
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	if err == nil {
+		f.defs = defs
+	}
+	f.mu.Unlock()
+	return err == nil, err
+}
+
+// 定期检查文件变化, 重新加载失败时通过notify报告, 同样的错误只报告一次
+func (f *CmdFile) Watch(interval time.Duration, notify func(err error)) {
+	if len(f.path) == 0 {
+		return
+	}
+	last_err := ""
+	for {
+		time.Sleep(interval)
+		ok, err := f.Reload()
+		if err != nil {
+			if err.Error() != last_err {
+				last_err = err.Error()
+				notify(err)
+			}
+			continue
+		}
+		last_err = ""
+		if ok {
+			log.Printf("reload %s", f.path)
+		}
+	}
+}
+
+func (f *CmdFile) Lookup(name string) (*CmdDef, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	def, ok := f.defs[name]
+	return def, ok
+}
+
+// 所有指令名和别名到指令名的映射
+func (f *CmdFile) Names() map[string]string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := make(map[string]string)
+	for k, def := range f.defs {
+		names[k] = def.name
+	}
+	return names
+}
+
+func (f *CmdFile) Help() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var lines []string
+	for name, def := range f.defs {
+		if name != def.name {
+			continue
+		}
+		line := def.Usage()
+		if len(def.Aliases) > 0 {
+			line += " (" + strings.Join(def.Aliases, "/") + ")"
+		}
+		if len(def.Help) > 0 {
+			line += "  " + def.Help
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,303 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ARG_WORD  string = "word"  //不含空白的单个参数
+	ARG_TEXT  string = "text"  //任意文本, 只能作为最后一个参数, 会吞掉后面所有的::
+	ARG_PHONE string = "phone" //手机号码
+	ARG_INT   string = "int"
+
+	CMD_SEP string = "::"
+
+	SECRET_MASK string = "****"
+)
+
+var phoneNumRgx = regexp.MustCompile(`^\+?\d{3,20}$`)
+
+type CmdArg struct {
+	Name     string
+	Kind     string
+	Optional bool
+	Secret   bool //PIN等参数在日志、通知和指令摘要中隐藏
+}
+
+type CmdArgs map[string]string
+
+// 一条待执行的指令以及它的来源
+type CmdRequest struct {
+	User   string
+	Text   string
+	Source string
+	Phone  string
+	Modem  string
+}
+
+func (args CmdArgs) Int(name string) int {
+	v, _ := strconv.Atoi(args[name])
+	return v
+}
+
+type Command struct {
+	Name    string
+	Aliases []string
+	Args    []CmdArg
+	Help    string
+	Role    int
+	Handler func(req CmdRequest, args CmdArgs) string
+}
+
+type ParsedCmd struct {
+	Command *Command
+	Name    string
+	Args    CmdArgs
+	Raw     string
+}
+
+type CmdError struct {
+	Input string
+	Msg   string
+}
+
+func (e *CmdError) Error() string {
+	return e.Msg
+}
+
+type CmdRegistry struct {
+	commands map[string]*Command
+	names    []string
+}
+
+func NewCmdRegistry() *CmdRegistry {
+	return &CmdRegistry{commands: make(map[string]*Command)}
+}
+
+func (r *CmdRegistry) Register(cmd *Command) {
+	r.commands[strings.ToLower(cmd.Name)] = cmd
+	for _, alias := range cmd.Aliases {
+		r.commands[strings.ToLower(alias)] = cmd
+	}
+	r.names = append(r.names, cmd.Name)
+}
+
+func (r *CmdRegistry) Lookup(name string) *Command {
+	return r.commands[strings.ToLower(name)]
+}
+
+// 所有指令名和别名到指令名的映射
+func (r *CmdRegistry) Names() map[string]string {
+	names := make(map[string]string)
+	for k, cmd := range r.commands {
+		names[k] = cmd.Name
+	}
+	return names
+}
+
+func (cmd *Command) Usage() string {
+	usage := cmd.Name
+	for _, arg := range cmd.Args {
+		if arg.Optional {
+			usage += CMD_SEP + "[" + arg.Name + "]"
+		} else {
+			usage += CMD_SEP + "<" + arg.Name + ">"
+		}
+	}
+	return usage
+}
+
+// 统一中文标点, 指令名中的标点(如语音识别结果末尾的句号)会被去掉, 参数保持原样
+func NormalizeCommand(input string) string {
+	input = strings.TrimSpace(input)
+	input = strings.ReplaceAll(input, "：：", CMD_SEP)
+	input = strings.ReplaceAll(input, "：:", CMD_SEP)
+	input = strings.ReplaceAll(input, ":：", CMD_SEP)
+	head, rest, found := strings.Cut(input, CMD_SEP)
+	head = strings.NewReplacer("，", "", ",", "", "。", "", "！", "", "!", "", "？", "", "?", "", " ", "").Replace(head)
+	if found {
+		return head + CMD_SEP + rest
+	}
+	return head
+}
+
+// 指令名后面可以用@指定模块, 如 sms@work::10086::CXYE, 返回去掉模块名的指令
+func SplitModemLabel(input string) (string, string) {
+	input = NormalizeCommand(input)
+	head, rest, found := strings.Cut(input, CMD_SEP)
+	name, label, ok := strings.Cut(strings.ReplaceAll(head, "＠", "@"), "@")
+	if !ok || len(name) == 0 || len(label) == 0 {
+		return input, ""
+	}
+	if found {
+		return name + CMD_SEP + rest, label
+	}
+	return name, label
+}
+
+// 隐藏指令中的Secret参数, 用于写日志和发通知, 参数格式有误时同样隐藏
+func (r *CmdRegistry) Mask(input string) string {
+	head, rest, found := strings.Cut(NormalizeCommand(input), CMD_SEP)
+	name, _, _ := strings.Cut(strings.ReplaceAll(head, "＠", "@"), "@")
+	cmd := r.Lookup(name)
+	if cmd == nil || !found || len(cmd.Args) == 0 {
+		return input
+	}
+	values := strings.SplitN(rest, CMD_SEP, len(cmd.Args))
+	masked := false
+	for i := range values {
+		if cmd.Args[i].Secret {
+			values[i] = SECRET_MASK
+			masked = true
+		}
+	}
+	if !masked {
+		return input
+	}
+	return head + CMD_SEP + strings.Join(values, CMD_SEP)
+}
+
+func (r *CmdRegistry) Parse(input string) (*ParsedCmd, error) {
+	input = NormalizeCommand(input)
+	if len(input) == 0 {
+		return nil, &CmdError{Input: input, Msg: "指令为空, 发送 help 查看可用指令"}
+	}
+	name, rest, has_args := strings.Cut(input, CMD_SEP)
+	cmd := r.Lookup(name)
+	if cmd == nil {
+		msg := "抱歉，未查到此: " + name + " 指令"
+		if guess := r.Suggest(name); len(guess) > 0 {
+			msg += ", 您是不是要找: " + guess
+		}
+		return nil, &CmdError{Input: input, Msg: msg + ", 发送 help 查看可用指令"}
+	}
+
+	var values []string
+	if has_args && (len(cmd.Args) > 0 || len(strings.TrimSpace(rest)) > 0) {
+		n := len(cmd.Args)
+		if n == 0 {
+			n = 1
+		}
+		values = strings.SplitN(rest, CMD_SEP, n)
+	}
+	if len(values) > len(cmd.Args) {
+		return nil, &CmdError{Input: input, Msg: cmd.Name + " 指令不需要参数, 用法: " + cmd.Usage()}
+	}
+
+	args := make(CmdArgs)
+	for i, arg := range cmd.Args {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		if arg.Kind != ARG_TEXT {
+			value = strings.TrimRight(strings.TrimSpace(value), "。.，,！!？? ")
+		}
+		if len(value) == 0 {
+			if arg.Optional {
+				continue
+			}
+			return nil, &CmdError{Input: input, Msg: "缺少参数 " + arg.Name + ", 用法: " + cmd.Usage()}
+		}
+		if err := checkArg(arg, value); err != nil {
+			return nil, &CmdError{Input: input, Msg: err.Error() + ", 用法: " + cmd.Usage()}
+		}
+		args[arg.Name] = value
+	}
+	return &ParsedCmd{Command: cmd, Name: name, Args: args, Raw: input}, nil
+}
+
+func IsPhoneNumber(value string) bool {
+	return phoneNumRgx.MatchString(value)
+}
+
+func checkArg(arg CmdArg, value string) error {
+	switch arg.Kind {
+	case ARG_PHONE:
+		if !phoneNumRgx.MatchString(value) {
+			return fmt.Errorf("抱歉，手机号码有误: %s", value)
+		}
+	case ARG_INT:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("参数 %s 应为数字: %s", arg.Name, value)
+		}
+	case ARG_WORD:
+		if strings.ContainsAny(value, " \t\r\n") {
+			return fmt.Errorf("参数 %s 不能包含空格: %s", arg.Name, value)
+		}
+	}
+	return nil
+}
+
+// 按编辑距离找出最接近的指令名或别名
+func (r *CmdRegistry) Suggest(name string) string {
+	best := ""
+	best_dist := 3
+	keys := make([]string, 0, len(r.commands))
+	for k := range r.commands {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		limit := len([]rune(k)) / 2
+		if limit > 2 {
+			limit = 2
+		}
+		dist := EditDistance(strings.ToLower(name), k)
+		if dist <= limit && dist < best_dist {
+			best, best_dist = k, dist
+		}
+	}
+	return best
+}
+
+// 只列出role有权限执行的指令
+func (r *CmdRegistry) Help(role int) string {
+	var lines []string
+	for _, name := range r.names {
+		cmd := r.commands[strings.ToLower(name)]
+		if cmd.Role > role {
+			continue
+		}
+		line := cmd.Usage()
+		if len(cmd.Aliases) > 0 {
+			line += " (" + strings.Join(cmd.Aliases, "/") + ")"
+		}
+		if len(cmd.Help) > 0 {
+			line += "\n    " + cmd.Help
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func EditDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
@@ -2,39 +2,77 @@ package utils
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jacobsa/go-serial/serial"
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/smtp"
+	"net/textproto"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
+	"utils/atparse"
 )
 
 const (
 	CMD_COPS      string = "AT+COPS?"
+	CMD_CSQ       string = "AT+CSQ"     //信号强度
+	CMD_CREG      string = "AT+CREG?"   //GSM网络注册状态
+	CMD_CEREG     string = "AT+CEREG?"  //LTE网络注册状态
+	CMD_CPIN      string = "AT+CPIN?"   //SIM卡状态
+	CMD_QNWINFO   string = "AT+QNWINFO" //EC20 当前网络制式和频段
 	CMD_CMGF      string = "AT+CMGF=1"
-	CMD_CSCS_UCS2 string = "AT+CSCS=\"UCS2\"" //设置编码
-	CMD_CSCS_GSM  string = "AT+CSCS=\"GSM\""  //设置编码
-	CMD_CSMP      string = "AT+CSMP=17,71,0,8"
+	CMD_CSCS_UCS2 string = "AT+CSCS=\"UCS2\""  //设置编码
+	CMD_CSCS_GSM  string = "AT+CSCS=\"GSM\""   //设置编码
+	CMD_CSMP      string = "AT+CSMP=49,71,0,8" //49: 请求状态报告
 	CMD_CMGFZ     string = "AT+CMGF=0"
 	CMD_CMGL_ALL  string = "AT+CMGL=\"REC UNREAD\"" //获取所有未读短信
 	CMD_CMGDA_ALL string = "AT+CMGD=1,3"            //SIM900A 这个指令为：AT+CMGDA="DEL ALL" 删除已读短信
 	CMD_CMGS      string = "AT+CMGS=\""             //发送短信指令 后跟手机号码
 	CMD_ATD       string = "ATD"                    //呼叫号码
 	CMD_ATH       string = "ATH"                    //挂机
+	CMD_CUSD      string = "AT+CUSD=1,\""           //发送USSD 后跟USSD代码或菜单选项
+	CMD_CUSD_END  string = "AT+CUSD=2"              //结束USSD会话
 	CMD_CTRL_Z    string = "\x1A"
 	CMD_LF_CR     string = "\r\n"
 	CMD_LF        string = "\r"
 	CACHE_SIZE    int    = 1024 * 8
+
+	CMGS_UNKNOWN_RESULT string = "UNKNOWN: port closed after write" //短信已写入串口但没有读到结果
+
+	AT_DEFAULT_TIMEOUT time.Duration = 10 * time.Second //等待最终结果码的时间
+	CMGS_TIMEOUT       time.Duration = time.Minute      //等待短信中心确认的时间
 )
 
+// 响应较慢的指令等待最终结果码的时间, 按前缀匹配
+var atTimeouts = map[string]time.Duration{
+	"AT+COPS=?":  3 * time.Minute, //搜索运营商
+	"AT+COPS=":   2 * time.Minute,
+	CMD_CMGL_ALL: 30 * time.Second,
+	CMD_CPBR:     30 * time.Second,
+}
+
+func atTimeout(cmd string) time.Duration {
+	timeout := AT_DEFAULT_TIMEOUT
+	for prefix, t := range atTimeouts {
+		if strings.HasPrefix(cmd, prefix) && t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
 type SendMsgResp struct {
 	ErrorCode   int    `json:"errorcode"`
 	Errmsg      string `json:"errmsg"`
@@ -47,6 +85,14 @@ type PhoneMsg struct {
 	Result    string
 	SendMSG   string
 	CmdDelay  uint
+	Quiet     bool          //定时查询余额时只在余额不足时通知
+	Phone     string        //发送短信的对方号码
+	User      string        //发起指令的账号, 发送结果和状态报告通知该账号
+	Prepare   []string      //在ATCmd之前连续执行的指令, 如设置字符集
+	Restore   []string      //在ATCmd之后恢复模块状态的指令
+	Reply     chan PhoneMsg //不为空时结果发给调用方, 结果中的上报另外交给ProcessATcmdResult
+
+	written bool //ATCmd已经写入串口
 }
 
 func CheckErr(err error) {
@@ -84,49 +130,235 @@ func IsUcs(body string) bool {
 		return false
 	}
 }
-func ExecATCmd(input chan PhoneMsg, result chan PhoneMsg, config Config) {
-	options := serial.OpenOptions{
-		PortName:        config.Device,
-		BaudRate:        config.Baudrate,
-		DataBits:        8,
-		StopBits:        1,
-		MinimumReadSize: 4,
+
+// 打开串口并执行指令队列, 串口断开或模块无响应时重置模块、等待设备重新出现后继续执行
+func ExecATCmd(modem *Modem, notify func(msg string), powerCycle func()) {
+	config := modem.Config
+	var pending *PhoneMsg
+	resets := 0
+	sim := NewSIMLock(config)
+	for {
+		device := WaitDevice(config, notify)
+		options := serial.OpenOptions{
+			PortName:              device,
+			BaudRate:              config.Baudrate,
+			DataBits:              8,
+			StopBits:              1,
+			MinimumReadSize:       0,
+			InterCharacterTimeout: 500,
+		}
+		port, err := serial.Open(options)
+		if err != nil {
+			log.Printf("open %s error: %v", device, err)
+			sleepOnError(config)
+			continue
+		}
+		if err = InitModem(port); err == nil {
+			sim.Unlock(port, notify)
+			if resets > 0 {
+				notify("模块已恢复: " + device)
+			}
+			resets = 0
+			err = serveATCmd(port, modem, &pending)
+		}
+		log.Printf("modem %s error: %v", device, err)
+		notify(fmt.Sprintf("模块异常: %v, 正在重置", err))
+		resets += 1
+		ResetModem(port, resets, powerCycle)
+		port.Close()
+		sleepOnError(config)
 	}
+}
 
-	port, err := serial.Open(options)
-	CheckErr(err)
-	defer port.Close()
-	info_cache := make([]byte, CACHE_SIZE)
+// 用户发起的指令优先于后台的定时查询
+func nextATCmd(modem *Modem) PhoneMsg {
+	select {
+	case msg := <-modem.Urgent:
+		return msg
+	default:
+	}
+	select {
+	case msg := <-modem.Urgent:
+		return msg
+	case msg := <-modem.Tasks:
+		return msg
+	}
+}
+
+// 写串口失败时返回错误, 当前指令保存在pending中, 重新打开串口后再执行
+func serveATCmd(port io.ReadWriteCloser, modem *Modem, pending **PhoneMsg) error {
+	timeouts := 0
 	for {
-		execphonemsg := <-input
-		if strings.HasPrefix(string(execphonemsg.ATCmd[:]), CMD_CMGS) {
-			bodys := strings.SplitN(string(execphonemsg.ATCmd[:]), ":::", 2)
-			tmp_control := string(bodys[0]) + CMD_LF
-			_, err = port.Write([]byte(tmp_control))
-			time.Sleep(time.Duration(1) * time.Second)
-			CheckErr(err)
-			port.Write([]byte(bodys[1]))
-			info_cache = make([]byte, CACHE_SIZE)
-			port.Read(info_cache)
-			execphonemsg.Result = string(info_cache[:])
-			result <- execphonemsg
+		var execphonemsg PhoneMsg
+		if *pending != nil {
+			execphonemsg = **pending
+			*pending = nil
 		} else {
-			_, err = port.Write(execphonemsg.ATCmd)
-			CheckErr(err)
+			execphonemsg = nextATCmd(modem)
+		}
+		if err := execTransaction(port, &execphonemsg); err != nil {
+			//短信可能已经发出, 重新执行会重复发送, 只报告结果未知
+			if execphonemsg.written && strings.HasPrefix(string(execphonemsg.ATCmd), CMD_CMGS) {
+				execphonemsg.Result = CMGS_UNKNOWN_RESULT
+				replyATCmd(modem, execphonemsg)
+				return err
+			}
+			*pending = &execphonemsg
+			return err
+		}
+		//存储在模块中的状态报告读出后删除, 和原结果一起交给ProcessATcmdResult
+		for _, idx := range StoredReports(execphonemsg.Result) {
+			report := PhoneMsg{ATCmd: []byte(fmt.Sprintf("%s%d%s", CMD_CMGR, idx, CMD_LF_CR))}
+			if err := execOnce(port, &report); err != nil {
+				break
+			}
+			execphonemsg.Result += "\n" + report.Result
+			execOnce(port, &PhoneMsg{ATCmd: []byte(fmt.Sprintf("%s%d%s", CMD_CMGD, idx, CMD_LF_CR))})
+		}
+		if !atparse.Final(execphonemsg.Result) {
+			//在指令的等待时间内没有最终结果码时按失败处理, 连续多次时认为模块卡死
+			if len(strings.TrimSpace(execphonemsg.Result)) == 0 {
+				execphonemsg.Result = AT_TIMEOUT_RESULT
+			}
+			timeouts += 1
+		} else {
+			timeouts = 0
+		}
+		replyATCmd(modem, execphonemsg)
+		if timeouts >= MODEM_MAX_TIMEOUTS {
+			return errors.New("模块无响应")
+		}
+	}
+}
+
+// 调用方等待的结果中也可能有状态报告、来电和USSD等上报, 先去掉指令交给ProcessATcmdResult处理
+func replyATCmd(modem *Modem, execphonemsg PhoneMsg) {
+	if execphonemsg.Reply == nil {
+		modem.Results <- execphonemsg
+		return
+	}
+	modem.Results <- PhoneMsg{Result: execphonemsg.Result}
+	execphonemsg.Reply <- execphonemsg
+}
+
+// Prepare, ATCmd, Restore 连续执行, 中间不会插入其他指令; Prepare失败时不执行ATCmd, 结果为失败的那一步
+func execTransaction(port io.ReadWriteCloser, execphonemsg *PhoneMsg) error {
+	execphonemsg.written = false
+	prepared := true
+	for _, cmd := range execphonemsg.Prepare {
+		step := PhoneMsg{ATCmd: []byte(cmd + CMD_LF_CR)}
+		if err := execOnce(port, &step); err != nil {
+			return err
+		}
+		if strings.Contains(step.Result, "ERROR") {
+			execphonemsg.Result = step.Result
+			prepared = false
+			break
+		}
+	}
+	if prepared {
+		if err := execOnce(port, execphonemsg); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range execphonemsg.Restore {
+		step := PhoneMsg{ATCmd: []byte(cmd + CMD_LF_CR)}
+		if err := execOnce(port, &step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func execOnce(port io.ReadWriteCloser, execphonemsg *PhoneMsg) error {
+	info_cache := make([]byte, CACHE_SIZE)
+	if strings.HasPrefix(string(execphonemsg.ATCmd[:]), CMD_CMGS) {
+		bodys := strings.SplitN(string(execphonemsg.ATCmd[:]), ":::", 2)
+		tmp_control := string(bodys[0]) + CMD_LF
+		if _, err := port.Write([]byte(tmp_control)); err != nil {
+			return err
+		}
+		execphonemsg.written = true
+		time.Sleep(time.Duration(1) * time.Second)
+		if _, err := port.Write([]byte(bodys[1])); err != nil {
+			return err
+		}
+		//+CMGS: <mr> 通常在发送后几秒才返回, 一直读到最终结果码为止
+		deadline := time.Now().Add(CMGS_TIMEOUT)
+		execphonemsg.Result = ""
+		for time.Now().Before(deadline) {
+			n, _ := port.Read(info_cache)
+			execphonemsg.Result += string(info_cache[:n])
+			if atparse.Final(execphonemsg.Result) {
+				break
+			}
+			if n == 0 {
+				time.Sleep(time.Duration(100) * time.Millisecond)
+			}
+		}
+	} else if strings.HasPrefix(string(execphonemsg.ATCmd), CMD_CUSD) {
+		//USSD的结果由网络异步返回, 一直读到+CUSD或ERROR为止
+		if _, err := port.Write(execphonemsg.ATCmd); err != nil {
+			return err
+		}
+		execphonemsg.written = true
+		deadline := time.Now().Add(time.Duration(USSD_TIMEOUT) * time.Second)
+		for time.Now().Before(deadline) {
 			time.Sleep(time.Duration(1) * time.Second)
-			port.Read(info_cache)
-			execphonemsg.Result = string(info_cache[:])
-			if strings.HasPrefix(execphonemsg.Result, ">") {
-				port.Write([]byte(CMD_CTRL_Z))
+			n, _ := port.Read(info_cache)
+			execphonemsg.Result += string(info_cache[:n])
+			if strings.Contains(execphonemsg.Result, "+CUSD:") || strings.Contains(execphonemsg.Result, "ERROR") {
+				break
+			}
+		}
+	} else if strings.HasPrefix(string(execphonemsg.ATCmd), CMD_QFDWL) {
+		//下载的文件是二进制, 连续读取以免串口缓冲区溢出, 读到+QFDWL和OK为止
+		if _, err := port.Write(execphonemsg.ATCmd); err != nil {
+			return err
+		}
+		execphonemsg.written = true
+		deadline := time.Now().Add(VOICEMAIL_DOWNLOAD_TIMEOUT)
+		for time.Now().Before(deadline) {
+			n, _ := port.Read(info_cache)
+			execphonemsg.Result += string(info_cache[:n])
+			if !strings.Contains(execphonemsg.Result, "CONNECT") && strings.Contains(execphonemsg.Result, "ERROR") {
+				break
+			}
+			if i := strings.LastIndex(execphonemsg.Result, "+QFDWL:"); i >= 0 && strings.Contains(execphonemsg.Result[i:], "OK") {
+				break
+			}
+		}
+	} else {
+		//读到最终结果码或>提示符为止, 每次读取最多等待InterCharacterTimeout
+		if _, err := port.Write(execphonemsg.ATCmd); err != nil {
+			return err
+		}
+		execphonemsg.written = true
+		deadline := time.Now().Add(atTimeout(string(execphonemsg.ATCmd)))
+		execphonemsg.Result = ""
+		for time.Now().Before(deadline) {
+			n, _ := port.Read(info_cache)
+			execphonemsg.Result += string(info_cache[:n])
+			if atparse.Final(execphonemsg.Result) || strings.HasPrefix(execphonemsg.Result, ">") {
+				break
 			}
-			result <- execphonemsg
-			info_cache = make([]byte, CACHE_SIZE)
+			if n == 0 {
+				time.Sleep(time.Duration(100) * time.Millisecond)
+			}
+		}
+		if strings.HasPrefix(execphonemsg.Result, ">") {
+			port.Write([]byte(CMD_CTRL_Z))
 		}
 	}
+	return nil
 }
-func AddCycleATCmd(input chan PhoneMsg) {
+
+func AddCycleATCmd(input chan PhoneMsg, dialect string) {
 	read_all_messages_cmd := []byte(CMD_CMGL_ALL + CMD_LF_CR)
 	clean_all_read_messages_cmd := []byte(CMD_CMGDA_ALL + CMD_LF_CR)
+	if dialect == DIALECT_SIM900A {
+		clean_all_read_messages_cmd = []byte(CMD_CMGDA_SIM900A + CMD_LF_CR)
+	}
 	i := 0
 	for {
 		raphoneMsg := PhoneMsg{CmdDelay: 1}
@@ -146,33 +378,48 @@ func AddCycleATCmd(input chan PhoneMsg) {
 	}
 }
 
-func ProcessATcmdResult(result chan PhoneMsg, config *Config, token *string) {
+func ProcessATcmdResult(modem *Modem, token *string, otpStore *OTPStore, inbound chan SMS) {
+	config := &modem.Config
 	for {
-		phoneMsg := <-result
+		phoneMsg := <-modem.Results
+		modem.Monitor.Update(string(phoneMsg.ATCmd), phoneMsg.Result)
+		modem.Voicemail.Ring(phoneMsg.Result)
+		subject := "来短信了"
 		//可以在这里对不同指令的处理结果
 		if strings.HasPrefix(string(phoneMsg.ATCmd), CMD_CMGL_ALL) && strings.Contains(phoneMsg.Result, "OK") {
-			msgs := strings.Split(phoneMsg.Result, CMD_LF_CR)
-			for i, m := range msgs {
-				if strings.HasPrefix(m, "+CMGL:") && strings.Contains(m, "UNREAD") {
-					tmp_info := strings.Split(msgs[i], ",\"")
-					src := strings.ReplaceAll(tmp_info[2], "\"", "")
-					src = strings.ReplaceAll(src, ",", "")
-					tmpsrc, _ := hex.DecodeString(src)
-					phonenum, _ := Ucs2ToUtf8(string(tmpsrc))
-					t := strings.Replace(tmp_info[3], "\"", "", -1) //SIM900A 格式应改为：tmp_info[4]
+			var otps []string
+			for _, msg := range atparse.ParseCMGL(phoneMsg.Result) {
+				if strings.Contains(msg.Status, "UNREAD") {
+					phonenum := decodeCharset(msg.Sender)
+					t := msg.Time
 					if len(phoneMsg.SendMSG) != 0 {
 						phoneMsg.SendMSG += "\n"
 					}
 					phoneMsg.SendMSG += "来源: " + phonenum + " 时间: " + t + "\n"
-					if IsUcs(msgs[i+1]) {
-						dat, _ := hex.DecodeString(msgs[i+1])
-						tmpmsg, _ := Ucs2ToUtf8(string(dat))
-						phoneMsg.SendMSG += tmpmsg
-					} else {
-						phoneMsg.SendMSG += msgs[i+1]
+					body := msg.Body
+					//读取被截断时正文可能不完整, 解码失败保留原文
+					if IsUcs(body) {
+						dat, _ := hex.DecodeString(body)
+						if s, err := Ucs2ToUtf8(string(dat)); err == nil {
+							body = s
+						}
+					}
+					phoneMsg.SendMSG += body
+					if otp := otpStore.Add(phonenum, body); otp != nil {
+						otps = append(otps, FormatOTP(otp))
+					}
+					select {
+					case inbound <- SMS{Sender: phonenum, Time: t, Body: body, Modem: config.Label}:
+					default:
+						log.Printf("inbound sms queue full, drop message from %s", phonenum)
 					}
 				}
 			}
+			//验证码放在最前面, 锁屏通知里可以直接看到
+			if len(otps) > 0 {
+				phoneMsg.SendMSG = strings.Join(otps, "\n") + "\n\n" + phoneMsg.SendMSG
+				subject = otps[0]
+			}
 		}
 		if strings.HasPrefix(string(phoneMsg.ATCmd), CMD_ATD) {
 			if strings.Contains(phoneMsg.Result, "OK") {
@@ -183,22 +430,85 @@ func ProcessATcmdResult(result chan PhoneMsg, config *Config, token *string) {
 		}
 
 		if strings.HasPrefix(string(phoneMsg.ATCmd), CMD_CMGS) {
-			if strings.Contains(phoneMsg.Result, "ERROR") {
-				phoneMsg.SendMSG = "发送短信失败"
+			//没有读到OK或错误时不能确定短信是否已提交
+			if e := atparse.ParseError(phoneMsg.Result); e != nil {
+				phoneMsg.SendMSG = "发送短信失败: " + e.Error()
+			} else if !atparse.OK(phoneMsg.Result) {
+				phoneMsg.SendMSG = "短信发送结果未知: 模块没有返回结果, 为避免重复发送不会自动重试, 请确认对方是否收到"
+			} else if ref := modem.Delivery.Submitted(phoneMsg.Phone, phoneMsg.User, phoneMsg.Result); ref >= 0 {
+				phoneMsg.SendMSG = fmt.Sprintf("短信已提交到短信中心(编号%d), 等待送达报告", ref)
 			} else {
-				phoneMsg.SendMSG = "发送短信成功"
+				phoneMsg.SendMSG = "短信已提交到短信中心"
+			}
+		}
+
+		//状态报告可能出现在任意指令的结果中, 通知发送短信的账号
+		reports, sent := modem.Delivery.Match(phoneMsg.Result)
+		for i, report := range reports {
+			touser := config.WxUser
+			if sent[i] != nil && len(sent[i].User) > 0 {
+				touser = sent[i].User
+			}
+			log.Printf("delivery report %d: %s %d", report.Ref, report.Phone, report.Status)
+			if config.SendWX {
+				SendWXMsg(modem.Tag()+FormatDelivery(report, sent[i]), config.WxAgentid, touser, *token)
+			}
+		}
+
+		if msg, ok := FormatSIMResult(string(phoneMsg.ATCmd), phoneMsg.Result); ok {
+			phoneMsg.SendMSG = msg
+			if strings.HasPrefix(string(phoneMsg.ATCmd), CMD_CPIN_SET) && atparse.OK(phoneMsg.Result) {
+				ClearSIMLockFailure(*config)
 			}
 		}
 
+		//USSD结果也可能在之后的读短信指令中才返回
+		if reply, ok := ParseCUSD(phoneMsg.Result); ok {
+			if len(phoneMsg.SendMSG) != 0 {
+				phoneMsg.SendMSG += "\n"
+			}
+			phoneMsg.SendMSG += FormatUSSD(reply)
+			if balance, ok := ParseBalance(reply.Text, config.BalanceRegex); ok && balance < config.BalanceAlert {
+				phoneMsg.SendMSG = fmt.Sprintf("余额不足: %.2f, 低于 %.2f\n", balance, config.BalanceAlert) + phoneMsg.SendMSG
+				subject = "余额不足"
+				phoneMsg.Quiet = false
+			} else if reply.Status > USSD_CLOSED {
+				phoneMsg.Quiet = false
+			}
+		} else if strings.HasPrefix(string(phoneMsg.ATCmd), CMD_CUSD) {
+			phoneMsg.SendMSG = "USSD查询失败或超时"
+			phoneMsg.Quiet = false
+		}
+		if phoneMsg.Quiet {
+			continue
+		}
+
+		//多个模块时标明是哪张SIM卡
+		if len(config.Label) > 0 && len(phoneMsg.SendMSG) > 0 {
+			phoneMsg.SendMSG = "[" + config.Label + "] " + phoneMsg.SendMSG
+			subject = "[" + config.Label + "] " + subject
+		}
 		if config.SendWX && len(phoneMsg.SendMSG) > 0 {
-			SendWXMsg(phoneMsg.SendMSG, config.WxAgentid, config.WxUser, *token)
+			touser := config.WxUser
+			if len(phoneMsg.User) > 0 {
+				touser = phoneMsg.User
+			}
+			SendWXMsg(phoneMsg.SendMSG, config.WxAgentid, touser, *token)
 		}
 		if config.SendMail && len(phoneMsg.SendMSG) > 0 {
-			SendMail(phoneMsg.SendMSG, "来短信了", *config)
+			SendMail(phoneMsg.SendMSG, subject, *config)
 		}
 	}
 }
 
+func FormatOTP(otp *OTP) string {
+	result := "验证码 " + otp.Code
+	if len(otp.Service) > 0 {
+		result += " 【" + otp.Service + "】"
+	}
+	return result
+}
+
 func SendWXMsg(msg_body string, agentid uint, touser string, accesstoken string) {
 
 	tmpwx := strings.Replace(msg_body, "<h3>", "", -1)
@@ -210,7 +520,63 @@ func SendWXMsg(msg_body string, agentid uint, touser string, accesstoken string)
 
 	jsonvals, _ := json.Marshal(send_msg_body)
 	sm_resp, err := http.Post(send_msg_url, "application/json", bytes.NewBuffer(jsonvals))
-	CheckErr(err)
+	//断网时只记录日志, 不能因为通知失败退出
+	if err != nil {
+		log.Printf("send wx msg error: %v", err)
+		return
+	}
+	defer sm_resp.Body.Close()
+	var smr SendMsgResp
+	smrb, _ := ioutil.ReadAll(sm_resp.Body)
+	json.Unmarshal(smrb, &smr)
+	if smr.ErrorCode != 0 {
+		log.Println(smr.Errmsg)
+	}
+}
+
+// 上传为临时素材后发送, AMR以语音消息发送(企业微信限制60秒、2MB以内), 其他格式以文件发送
+func SendWXFile(path string, agentid uint, touser string, accesstoken string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("read wx file %s error: %v", path, err)
+		return
+	}
+	mediaType := "file"
+	if DetectAudioFormat(data) == AUDIO_AMR && len(data) <= 2*1024*1024 {
+		mediaType = "voice"
+	}
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	part, _ := w.CreateFormFile("media", filepath.Base(path))
+	part.Write(data)
+	w.Close()
+	upload_url := "https://qyapi.weixin.qq.com/cgi-bin/media/upload?access_token=" + accesstoken + "&type=" + mediaType
+	up_resp, err := http.Post(upload_url, w.FormDataContentType(), &form)
+	if err != nil {
+		log.Printf("upload wx media error: %v", err)
+		return
+	}
+	defer up_resp.Body.Close()
+	var media struct {
+		SendMsgResp
+		MediaID string `json:"media_id"`
+	}
+	upb, _ := ioutil.ReadAll(up_resp.Body)
+	json.Unmarshal(upb, &media)
+	if len(media.MediaID) == 0 {
+		log.Printf("upload wx media error: %s", media.Errmsg)
+		return
+	}
+
+	send_msg_url := "https://qyapi.weixin.qq.com/cgi-bin/message/send?access_token=" + accesstoken
+	media_content := map[string]string{"media_id": media.MediaID}
+	send_msg_body := map[string]interface{}{"msgtype": mediaType, "touser": touser, "agentid": agentid, mediaType: media_content}
+	jsonvals, _ := json.Marshal(send_msg_body)
+	sm_resp, err := http.Post(send_msg_url, "application/json", bytes.NewBuffer(jsonvals))
+	if err != nil {
+		log.Printf("send wx file error: %v", err)
+		return
+	}
 	defer sm_resp.Body.Close()
 	var smr SendMsgResp
 	smrb, _ := ioutil.ReadAll(sm_resp.Body)
@@ -222,7 +588,6 @@ func SendWXMsg(msg_body string, agentid uint, touser string, accesstoken string)
 
 func SendMail(body string, subject string, config Config) {
 	from := config.MailFrom
-	pass := config.MailPass
 	to := config.MailTo
 
 	msg := "From: " + from + "\r\n" +
@@ -231,10 +596,58 @@ func SendMail(body string, subject string, config Config) {
 		"Content-Type: text/html; charset=UTF-8\r\n\r\n" +
 		body
 
+	sendMailMsg(msg, config)
+}
+
+// 正文为纯文本, 附件按base64编码
+func SendMailFile(body string, subject string, path string, config Config) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("read mail attachment %s error: %v", path, err)
+		SendMail(body, subject, config)
+		return
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	part, _ := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	part.Write([]byte(body))
+	name := filepath.Base(path)
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if len(ctype) == 0 {
+		ctype = "application/octet-stream"
+	}
+	part, _ = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {ctype},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+	})
+	encoded := base64.StdEncoding.EncodeToString(data)
+	//每行不超过76个字符
+	for len(encoded) > 76 {
+		part.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	part.Write([]byte(encoded + "\r\n"))
+	w.Close()
+
+	msg := "From: " + config.MailFrom + "\r\n" +
+		"To: " + config.MailTo + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=" + w.Boundary() + "\r\n\r\n" +
+		buf.String()
+	sendMailMsg(msg, config)
+}
+
+func sendMailMsg(msg string, config Config) {
 	addr := fmt.Sprintf("%s:%d", config.MailServer, config.MailServerPort)
 	err := smtp.SendMail(addr,
-		smtp.PlainAuth("", from, pass, config.MailServer),
-		from, []string{to}, []byte(msg))
-
-	CheckErr(err)
+		smtp.PlainAuth("", config.MailFrom, config.MailPass, config.MailServer),
+		config.MailFrom, []string{config.MailTo}, []byte(msg))
+	if err != nil {
+		log.Printf("send mail error: %v", err)
+	}
 }
@@ -24,6 +24,38 @@ type Config struct {
 	BaiDuYuYingSecret string  `json:"bdyysecret"`
 	BaiDuYuYingCuid   string  `json:"cuid"`
 
+	Fan FanConfig `json:"fan"` //风扇控制, 没有配置curve时按cpufanstart开关
+
+	Sensors       []SensorConfig `json:"sensors"`
+	SensorAlerts  []SensorAlert  `json:"sensoralerts"`
+	SensorHistory int            `json:"sensorhistory"`
+
+	SpeechBackend    string  `json:"speechbackend"`
+	SpeechURL        string  `json:"speechurl"`
+	SpeechModel      string  `json:"speechmodel"`
+	SpeechRate       int     `json:"speechrate"`
+	SpeechToken      string  `json:"speechtoken"`
+	SpeechTimeout    uint    `json:"speechtimeout"`
+	SpeechConfidence float64 `json:"speechconfidence"`
+	FFmpeg           string  `json:"ffmpeg"`
+	FFmpegTimeout    uint    `json:"ffmpegtimeout"`
+
+	VoiceIntents   map[string]string `json:"voiceintents"`
+	VoiceThreshold float64           `json:"voicethreshold"`
+
+	SayMode          string   `json:"saymode"`
+	SayCommand       []string `json:"saycommand"`
+	SayAudioDevice   string   `json:"sayaudiodevice"`
+	SayRepeat        int      `json:"sayrepeat"`
+	SayAnswerTimeout uint     `json:"sayanswertimeout"`
+
+	VoicemailRings      int    `json:"voicemailrings"`
+	VoicemailGreeting   string `json:"voicemailgreeting"`
+	VoicemailRecord     string `json:"voicemailrecord"`
+	VoicemailSeconds    uint   `json:"voicemailseconds"`
+	VoicemailDir        string `json:"voicemaildir"`
+	VoicemailTranscribe bool   `json:"voicemailtranscribe"`
+
 	Port         uint16 `json:"port"`
 	SSL          bool   `json:"ssl"`
 	AESKEY       string `json:"aeskey"`
@@ -36,4 +68,61 @@ type Config struct {
 	CertFile     string `json:"certfile"`
 	KeyFile      string `json:"keyfile"`
 	CMDFile      string `json:"cmdfile"`
+
+	RateLimit   float64  `json:"ratelimit"`
+	RateBurst   uint     `json:"rateburst"`
+	MaxFailures uint     `json:"maxfailures"`
+	BanTime     uint     `json:"bantime"`
+	AllowIPs    []string `json:"allowips"`
+	AdminURL    string   `json:"adminurl"`
+
+	ACL         map[string]string `json:"acl"`
+	DefaultRole string            `json:"defaultrole"`
+	CMDFileRole string            `json:"cmdfilerole"`
+
+	Scripts       map[string]Script `json:"scripts"`
+	AllowRawCmd   bool              `json:"allowrawcmd"`
+	ScriptTimeout uint              `json:"scripttimeout"`
+	ScriptUser    string            `json:"scriptuser"`
+	ScriptDir     string            `json:"scriptdir"`
+	ScriptEnv     []string          `json:"scriptenv"`
+	PageSize      int               `json:"pagesize"`
+
+	ConfirmCmds    []string `json:"confirmcmds"`
+	ConfirmTimeout uint     `json:"confirmtimeout"`
+
+	Schedules    []ScheduleConfig `json:"schedules"`
+	ScheduleFile string           `json:"schedulefile"`
+
+	OTPPatterns []string `json:"otppatterns"`
+	OTPExpire   uint     `json:"otpexpire"`
+	OTPListen   string   `json:"otplisten"`
+	OTPToken    string   `json:"otptoken"`
+
+	SMSRules []SMSRule `json:"smsrules"`
+	Contacts []string  `json:"contacts"`
+	AwayMode bool      `json:"awaymode"`
+
+	SMSControl map[string]string `json:"smscontrol"`
+	SMSPin     string            `json:"smspin"`
+	SMSTOTP    string            `json:"smstotp"`
+
+	BalanceRegex string  `json:"balanceregex"`
+	BalanceAlert float64 `json:"balancealert"`
+
+	ModemCheck  uint `json:"modemcheck"`
+	SignalAlert int  `json:"signalalert"`
+
+	DeviceUSB     string `json:"deviceusb"`
+	ModemPowerPin uint   `json:"modempowerpin"`
+
+	SIMPin      string `json:"simpin"`
+	SIMPinFile  string `json:"simpinfile"`
+	SIMLockFile string `json:"simlockfile"`
+
+	Label       string        `json:"label"`
+	Dialect     string        `json:"dialect"`
+	Number      string        `json:"number"`
+	Modems      []ModemConfig `json:"modems"`
+	ModemRoutes []ModemRoute  `json:"modemroutes"`
 }
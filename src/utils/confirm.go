@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CONFIRM_TIMEOUT uint = 120
+	CONFIRM_CODE_LEN        int  = 4
+)
+
+// 等待发起人回复确认码的指令
+type PendingCmd struct {
+	Code    string
+	Req     CmdRequest
+	Summary string
+	Run     func() string
+	Expires time.Time
+}
+
+type Confirmer struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	timeout time.Duration
+	pending map[string]*PendingCmd
+}
+
+func NewConfirmer(config Config) *Confirmer {
+	timeout := config.ConfirmTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_CONFIRM_TIMEOUT
+	}
+	c := &Confirmer{
+		names:   make(map[string]bool),
+		timeout: time.Duration(timeout) * time.Second,
+		pending: make(map[string]*PendingCmd),
+	}
+	for _, name := range config.ConfirmCmds {
+		c.names[strings.ToLower(name)] = true
+	}
+	return c
+}
+
+func (c *Confirmer) Need(name string) bool {
+	return c.names[strings.ToLower(name)]
+}
+
+// 记录待确认的指令并返回确认码, 同一账号新的待确认指令会覆盖旧的
+func (c *Confirmer) Add(req CmdRequest, summary string, run func() string) string {
+	code := ""
+	for i := 0; i < CONFIRM_CODE_LEN; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		CheckErr(err)
+		code += n.String()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[req.User] = &PendingCmd{Code: code, Req: req, Summary: summary, Run: run, Expires: time.Now().Add(c.timeout)}
+	return code
+}
+
+func (c *Confirmer) Timeout() time.Duration {
+	return c.timeout
+}
+
+// 消息看起来像确认码时取出该账号待确认的指令, 确认码错误或过期时待确认的指令作废
+func (c *Confirmer) Take(user string, text string) (*PendingCmd, error) {
+	text = strings.TrimRight(strings.TrimSpace(text), "。.")
+	if len(text) != CONFIRM_CODE_LEN || strings.Trim(text, "0123456789") != "" {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending, ok := c.pending[user]
+	if !ok {
+		return nil, nil
+	}
+	delete(c.pending, user)
+	if time.Now().After(pending.Expires) {
+		return nil, fmt.Errorf("确认码已过期, 指令 %s 已取消", pending.Summary)
+	}
+	if pending.Code != text {
+		return nil, fmt.Errorf("确认码错误, 指令 %s 已取消", pending.Summary)
+	}
+	return pending, nil
+}
+
+// 生成指令的摘要, 参数按定义的顺序列出
+func (parsed *ParsedCmd) Summary() string {
+	summary := parsed.Command.Name
+	for _, arg := range parsed.Command.Args {
+		if v, ok := parsed.Args[arg.Name]; ok {
+			if arg.Secret {
+				v = SECRET_MASK
+			}
+			summary += " " + arg.Name + "=" + v
+		}
+	}
+	return summary
+}
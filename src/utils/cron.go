@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 标准的5段cron表达式: 分 时 日 月 周, 支持 * , - / 以及 @hourly 等简写
+type CronExpr struct {
+	minute  [60]bool
+	hour    [24]bool
+	day     [32]bool
+	month   [13]bool
+	weekday [7]bool
+	anyDay  bool
+	anyWeek bool
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+func ParseCron(expr string) (*CronExpr, error) {
+	expr = strings.TrimSpace(expr)
+	if v, ok := cronShortcuts[expr]; ok {
+		expr = v
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron表达式需要5段: %s", expr)
+	}
+	c := &CronExpr{anyDay: fields[2] == "*", anyWeek: fields[4] == "*"}
+	if err := parseCronField(fields[0], 0, 59, c.minute[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(fields[1], 0, 23, c.hour[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(fields[2], 1, 31, c.day[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(fields[3], 1, 12, c.month[:]); err != nil {
+		return nil, err
+	}
+	week := make([]bool, 8)
+	if err := parseCronField(fields[4], 0, 7, week); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 7; i++ {
+		c.weekday[i] = week[i]
+	}
+	if week[7] {
+		c.weekday[0] = true
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min int, max int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return fmt.Errorf("cron步长有误: %s", part)
+			}
+			part = part[:idx]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return fmt.Errorf("cron字段有误: %s", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return fmt.Errorf("cron字段有误: %s", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("cron字段超出范围 %d-%d: %s", min, max, part)
+		}
+		for i := lo; i <= hi; i += step {
+			set[i] = true
+		}
+	}
+	return nil
+}
+
+// 日和周同时限定时满足其一即可, 与常见的cron实现一致
+func (c *CronExpr) matchDay(t time.Time) bool {
+	if c.anyDay || c.anyWeek {
+		return c.day[t.Day()] && c.weekday[t.Weekday()]
+	}
+	return c.day[t.Day()] || c.weekday[t.Weekday()]
+}
+
+// 返回t之后(不含t所在的分钟)第一个满足表达式的时间
+func (c *CronExpr) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
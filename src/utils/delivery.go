@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"utils/atparse"
+)
+
+const (
+	CMD_CNMI_DS     string        = "AT+CNMI=2,1,0,1,0" //状态报告通过+CDS直接上报
+	CMD_CMGR        string        = "AT+CMGR="          //读取指定编号的短信 后跟编号
+	CMD_CMGD        string        = "AT+CMGD="          //删除指定编号的短信 后跟编号
+	DELIVERY_EXPIRE time.Duration = 72 * time.Hour
+)
+
+// 已提交的短信, 按模块返回的编号(mr)等待状态报告
+type OutgoingSMS struct {
+	Phone string
+	User  string
+	Sent  time.Time
+	Ref   int
+}
+
+type DeliveryReport struct {
+	Ref       int
+	Phone     string
+	Submitted string
+	Done      string
+	Status    int
+}
+
+// 按GSM 03.40的TP-Status分类
+func (r DeliveryReport) State() string {
+	switch {
+	case r.Status < 32:
+		return "已送达"
+	case r.Status < 64:
+		return "暂时无法送达, 短信中心会继续尝试"
+	case r.Status == 70:
+		return "已过期, 未送达"
+	default:
+		return fmt.Sprintf("发送失败(状态码%d)", r.Status)
+	}
+}
+
+// 最终状态的报告之后不会再有该编号的报告
+func (r DeliveryReport) Final() bool {
+	return r.Status < 32 || r.Status >= 64
+}
+
+type DeliveryTracker struct {
+	mu   sync.Mutex
+	sent map[int]*OutgoingSMS
+}
+
+func NewDeliveryTracker() *DeliveryTracker {
+	return &DeliveryTracker{sent: make(map[int]*OutgoingSMS)}
+}
+
+// 从+CMGS的结果中取出编号并记录, 没有编号时返回-1
+func (t *DeliveryTracker) Submitted(phone string, user string, result string) int {
+	ref := atparse.ParseCMGS(result)
+	if ref < 0 {
+		return -1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, v := range t.sent {
+		if now.Sub(v.Sent) > DELIVERY_EXPIRE {
+			delete(t.sent, k)
+		}
+	}
+	t.sent[ref] = &OutgoingSMS{Phone: phone, User: user, Sent: now, Ref: ref}
+	return ref
+}
+
+// 返回结果中的所有状态报告以及对应的已发送短信, 找不到对应短信时为nil
+func (t *DeliveryTracker) Match(result string) ([]DeliveryReport, []*OutgoingSMS) {
+	var reports []DeliveryReport
+	var sent []*OutgoingSMS
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range atparse.ParseCDS(result) {
+		report := DeliveryReport{Ref: r.Ref, Phone: decodeCharset(r.Recipient), Submitted: r.Submitted, Done: r.Done, Status: r.Status}
+		s := t.sent[report.Ref]
+		if s != nil && report.Final() {
+			delete(t.sent, report.Ref)
+		}
+		reports = append(reports, report)
+		sent = append(sent, s)
+	}
+	return reports, sent
+}
+
+// 存储在模块中的状态报告(+CDSI)的编号
+func StoredReports(result string) []int {
+	var idxs []int
+	for _, ind := range atparse.ParseIndications(result) {
+		if ind.Kind == "CDSI" {
+			idxs = append(idxs, ind.Index)
+		}
+	}
+	return idxs
+}
+
+func FormatDelivery(report DeliveryReport, sent *OutgoingSMS) string {
+	phone := report.Phone
+	if sent != nil {
+		phone = sent.Phone
+	}
+	return fmt.Sprintf("短信状态报告: %s %s\n提交: %s\n完成: %s", phone, report.State(), report.Submitted, report.Done)
+}
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_FAN_INTERVAL   uint    = 5
+	DEFAULT_FAN_HYSTERESIS float64 = 3
+	DEFAULT_FAN_FREQ       int     = 25000 //4线PWM风扇的标准频率
+	DEFAULT_THERMAL_FILE   string  = "/sys/class/thermal/thermal_zone0/temp"
+	FAN_AUTO               int     = -1
+)
+
+// 温度到占空比(0-100)的一个点, 两点之间线性插值, 低于第一个点时停转
+type FanPoint struct {
+	Temp float64 `json:"temp"`
+	Duty int     `json:"duty"`
+}
+
+// 一个温度传感器, 没有设置curve时使用fan中的curve
+type ThermalZone struct {
+	Name  string     `json:"name"`
+	File  string     `json:"file"`
+	Curve []FanPoint `json:"curve"`
+}
+
+type FanConfig struct {
+	Pin        uint          `json:"pin"`
+	PWM        bool          `json:"pwm"`
+	Freq       int           `json:"freq"`
+	Interval   uint          `json:"interval"`
+	Hysteresis float64       `json:"hysteresis"`
+	Step       bool          `json:"step"`
+	Curve      []FanPoint    `json:"curve"`
+	Zones      []ThermalZone `json:"zones"`
+}
+
+// 控制风扇的硬件, 不支持PWM时占空比大于0即全速
+type FanDriver interface {
+	SetDuty(duty int) error
+}
+
+type ZoneTemp struct {
+	Name string
+	Temp float64
+	Err  error
+}
+
+// 多个温度传感器时取各自曲线计算出的最大占空比, 读取失败时全速运转
+type FanController struct {
+	mu       sync.Mutex
+	config   FanConfig
+	driver   FanDriver
+	alert    func(msg string)
+	tracked  []float64 //带回差的温度, 升温时立即跟随, 降温超过hysteresis才跟随
+	temps    []ZoneTemp
+	duty     int
+	override int
+	failed   bool
+}
+
+// 没有配置fan时按旧的cpufanstart等配置: 高于启动温度3度开启, 低于启动温度6度关闭
+func NewFanConfig(config Config) FanConfig {
+	fan := config.Fan
+	if fan.Pin == 0 {
+		fan.Pin = config.CPUFanConPin
+	}
+	if len(fan.Curve) == 0 && len(fan.Zones) == 0 {
+		fan.Curve = []FanPoint{{Temp: float64(config.CPUFanStart) + 3, Duty: 100}}
+		fan.Hysteresis = 9
+		if config.TempInterval > 0 {
+			fan.Interval = config.TempInterval * 60
+		}
+	}
+	if len(fan.Zones) == 0 {
+		file := config.CPUTempFile
+		if len(file) == 0 {
+			file = DEFAULT_THERMAL_FILE
+		}
+		fan.Zones = []ThermalZone{{Name: "cpu", File: file}}
+	}
+	for i := range fan.Zones {
+		if len(fan.Zones[i].Curve) == 0 {
+			fan.Zones[i].Curve = fan.Curve
+		}
+		sort.Slice(fan.Zones[i].Curve, func(a, b int) bool { return fan.Zones[i].Curve[a].Temp < fan.Zones[i].Curve[b].Temp })
+		if len(fan.Zones[i].Name) == 0 {
+			fan.Zones[i].Name = fmt.Sprintf("zone%d", i)
+		}
+	}
+	if fan.Interval == 0 {
+		fan.Interval = DEFAULT_FAN_INTERVAL
+	}
+	if fan.Hysteresis == 0 {
+		fan.Hysteresis = DEFAULT_FAN_HYSTERESIS
+	}
+	if fan.Freq == 0 {
+		fan.Freq = DEFAULT_FAN_FREQ
+	}
+	return fan
+}
+
+func NewFanController(fan FanConfig, driver FanDriver, alert func(msg string)) *FanController {
+	return &FanController{
+		config:   fan,
+		driver:   driver,
+		alert:    alert,
+		tracked:  make([]float64, len(fan.Zones)),
+		duty:     -1,
+		override: FAN_AUTO,
+	}
+}
+
+func (f *FanController) Run() {
+	for {
+		f.Check()
+		time.Sleep(time.Duration(f.config.Interval) * time.Second)
+	}
+}
+
+// 读取一次温度并设置风扇
+func (f *FanController) Check() {
+	temps := make([]ZoneTemp, len(f.config.Zones))
+	for i, zone := range f.config.Zones {
+		temps[i] = ZoneTemp{Name: zone.Name}
+		temps[i].Temp, temps[i].Err = ReadTemp(zone.File)
+	}
+
+	f.mu.Lock()
+	f.temps = temps
+	duty := 0
+	var errs []string
+	for i, t := range temps {
+		if t.Err != nil {
+			errs = append(errs, t.Name+": "+t.Err.Error())
+			continue
+		}
+		if f.tracked[i] == 0 || t.Temp > f.tracked[i] {
+			f.tracked[i] = t.Temp
+		} else if t.Temp < f.tracked[i]-f.config.Hysteresis {
+			f.tracked[i] = t.Temp + f.config.Hysteresis
+		}
+		if d := CurveDuty(f.config.Zones[i].Curve, f.tracked[i], f.config.Step); d > duty {
+			duty = d
+		}
+	}
+	var alert string
+	if len(errs) > 0 {
+		duty = 100
+		if !f.failed {
+			alert = "温度读取失败, 风扇全速运转: " + strings.Join(errs, "; ")
+		}
+	} else if f.failed {
+		alert = "温度读取已恢复"
+	}
+	f.failed = len(errs) > 0
+	if f.override != FAN_AUTO && !f.failed {
+		duty = f.override
+	}
+	err := f.set(duty)
+	f.mu.Unlock()
+
+	if err != nil {
+		alert = "风扇控制失败: " + err.Error()
+	}
+	if len(alert) > 0 && f.alert != nil {
+		f.alert(alert)
+	}
+}
+
+// 调用时需要持有锁
+func (f *FanController) set(duty int) error {
+	if !f.config.PWM && duty > 0 {
+		duty = 100
+	}
+	if duty == f.duty {
+		return nil
+	}
+	if err := f.driver.SetDuty(duty); err != nil {
+		return err
+	}
+	f.duty = duty
+	return nil
+}
+
+// duty为FAN_AUTO时恢复按温度控制, 传感器故障时手动设置不生效
+func (f *FanController) Override(duty int) error {
+	if duty != FAN_AUTO && (duty < 0 || duty > 100) {
+		return errors.New("占空比应为0-100")
+	}
+	f.mu.Lock()
+	f.override = duty
+	f.mu.Unlock()
+	f.Check()
+	return nil
+}
+
+func (f *FanController) Status() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mode := "自动"
+	if f.override != FAN_AUTO {
+		mode = "手动"
+	}
+	if f.failed {
+		mode = "传感器故障, 全速"
+	}
+	status := fmt.Sprintf("风扇: %d%% (%s)", f.duty, mode)
+	if !f.config.PWM {
+		status = "风扇: 停止 (" + mode + ")"
+		if f.duty > 0 {
+			status = "风扇: 运转 (" + mode + ")"
+		}
+	}
+	for _, t := range f.temps {
+		if t.Err != nil {
+			status += "\n" + t.Name + ": 读取失败 " + t.Err.Error()
+		} else {
+			status += fmt.Sprintf("\n%s: %.1f°C", t.Name, t.Temp)
+		}
+	}
+	return status
+}
+
+// 低于第一个点时为0, 高于最后一个点时为最后一个点的占空比; step为true时不插值, 按分档运转
+func CurveDuty(curve []FanPoint, temp float64, step bool) int {
+	if len(curve) == 0 || temp < curve[0].Temp {
+		return 0
+	}
+	for i := len(curve) - 1; i >= 0; i-- {
+		if temp < curve[i].Temp {
+			continue
+		}
+		if step || i == len(curve)-1 {
+			return curve[i].Duty
+		}
+		next := curve[i+1]
+		return curve[i].Duty + int(float64(next.Duty-curve[i].Duty)*(temp-curve[i].Temp)/(next.Temp-curve[i].Temp))
+	}
+	return 0
+}
+
+// thermal_zone中是毫摄氏度, 也兼容直接写摄氏度的传感器文件
+func ReadTemp(filename string) (float64, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	temp, err := strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if temp > 1000 {
+		temp /= 1000
+	}
+	return temp, nil
+}
@@ -0,0 +1,324 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	DEFAULT_VOICE_THRESHOLD float64       = 0.6
+	VOICE_CHOICE_EXPIRE     time.Duration = 2 * time.Minute
+	VOICE_MAX_CHOICES       int           = 3
+)
+
+// 常用的繁体字, 语音识别偶尔会输出繁体
+var tradToSimp = buildRuneMap("開开關关燈灯發发簡简訊讯電电話话號号碼码錢钱餘余額额態态聽听說说給给掛挂撥拨調调溫温濕湿機机設设幫帮離离務务時时條条這这個个們们門门風风視视廳厅臥卧熱热氣气鐘钟點点來来為为讓让麼么嗎吗請请鎖锁簾帘暫暂啟启動动斷断網网絡络費费狀状況况幾几兩两問问題题間间裡里體体錄录傳传連连節节")
+
+// 中文数字, 语音识别有时把号码识别为汉字
+var cnDigits = map[rune]rune{'零': '0', '〇': '0', '一': '1', '幺': '1', '二': '2', '两': '2', '三': '3', '四': '4', '五': '5', '六': '6', '七': '7', '八': '8', '九': '9'}
+
+var cnDigitsRgx = regexp.MustCompile(`[零〇一幺二两三四五六七八九]{3,}`)
+
+// 只收录指令中常见的字, 不在表中的字按字本身比较
+var pinyinTable = map[string]string{
+	"a": "啊阿", "ai": "爱", "an": "安按暗", "ba": "把吧八", "bai": "白百", "ban": "半办班", "bang": "帮", "bao": "报保包",
+	"bei": "被备北", "ben": "本", "bi": "比闭", "bian": "边变", "biao": "表", "bie": "别", "bo": "播拨", "bu": "不步部布",
+	"ka": "卡", "cai": "才菜", "can": "参", "ce": "测", "cha": "查茶插", "chang": "长常场", "che": "车", "chi": "吃",
+	"chu": "出除处", "chuang": "窗床", "chuan": "穿传", "ci": "次", "cong": "从", "cuo": "错", "da": "打大", "dai": "带待",
+	"dan": "单但", "dao": "到道", "de": "的得", "deng": "灯等", "di": "地低第", "dian": "电点", "diao": "掉", "ding": "定订",
+	"dong": "动东", "dou": "都", "du": "度读", "duan": "短断", "dui": "对", "duo": "多", "e": "额", "er": "二儿", "fa": "发",
+	"fan": "反", "fang": "房放", "fei": "费", "fen": "分", "feng": "风", "fu": "服复", "gai": "改", "gao": "高告", "ge": "个歌",
+	"gei": "给", "gen": "跟", "geng": "更", "gong": "功公", "guan": "关管", "gua": "挂", "gui": "柜", "guo": "过", "hao": "号好",
+	"he": "和", "hou": "后", "hu": "呼户", "hua": "话", "huan": "换", "hui": "回会", "huo": "或", "ji": "机几记计", "jia": "家加",
+	"jian": "件间", "jiang": "讲", "jiao": "叫", "jie": "接结", "jin": "进今", "jing": "静", "jiu": "就九", "kai": "开",
+	"kan": "看", "ke": "客可", "kong": "空控", "kou": "口", "la": "拉", "lai": "来", "li": "离里", "liang": "亮两", "lian": "连帘",
+	"ling": "零铃", "liu": "六", "lou": "楼", "lu": "路录", "ma": "吗码马", "mei": "没", "men": "门们",
+	"mi": "密", "ming": "明", "mo": "模", "na": "那拿", "ne": "呢", "ni": "你", "nuan": "暖", "qi": "气七起启", "qian": "钱前",
+	"qing": "请情", "qu": "取去", "que": "确", "ren": "人任", "ri": "日", "ru": "入", "san": "三", "sao": "扫", "shan": "删",
+	"she": "设", "sheng": "声", "shi": "是时十视室湿", "shou": "手收", "shu": "数书", "shui": "水", "shuo": "说", "si": "四",
+	"song": "送", "suan": "算", "suo": "锁", "ta": "他她", "tai": "态台", "tiao": "调条", "ting": "停听厅", "tong": "通",
+	"wan": "晚完", "wang": "网", "wei": "位", "wen": "温问", "wo": "我卧", "wu": "五无务", "xi": "洗息", "xia": "下",
+	"xiang": "想", "xiao": "小消", "xin": "信新", "yao": "要幺", "yi": "一", "yin": "音", "yong": "用", "you": "有",
+	"yu": "余语", "zai": "在", "zhe": "这", "zhi": "指", "zhu": "主助", "zhuang": "状",
+}
+
+var pinyinOf = buildPinyin()
+
+var (
+	smsIntentRgxs = []*regexp.Regexp{
+		regexp.MustCompile(`^(?:请|帮我)?给(\+?\d{3,20})发(?:个|一条|条)?短信[\s,，:：]*(?:说|内容是|内容)?[\s,，:：]*(.+)$`),
+		regexp.MustCompile(`^(?:请|帮我)?发(?:个|一条|条)?短信给(\+?\d{3,20})[\s,，:：]*(?:说|内容是|内容)?[\s,，:：]*(.+)$`),
+	}
+	dialIntentRgxs = []*regexp.Regexp{
+		regexp.MustCompile(`^(?:请|帮我)?给(\+?\d{3,20})打(?:个|一个)?电话$`),
+		regexp.MustCompile(`^(?:请|帮我)?(?:打电话给|拨打|呼叫|拨号|打给)(\+?\d{3,20})$`),
+	}
+)
+
+func buildRuneMap(pairs string) map[rune]rune {
+	m := make(map[rune]rune)
+	runes := []rune(pairs)
+	for i := 0; i+1 < len(runes); i += 2 {
+		m[runes[i]] = runes[i+1]
+	}
+	return m
+}
+
+func buildPinyin() map[rune]string {
+	m := make(map[rune]string)
+	for py, chars := range pinyinTable {
+		for _, r := range chars {
+			m[r] = py
+		}
+	}
+	return m
+}
+
+// 全角转半角, 繁体转简体, 号码中的中文数字转为阿拉伯数字, 保留标点和空格
+func NormalizeSpeechText(text string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(text) {
+		switch {
+		case r == '　':
+			r = ' '
+		case r >= '！' && r <= '～':
+			r -= 0xfee0
+		}
+		if s, ok := tradToSimp[r]; ok {
+			r = s
+		}
+		b.WriteRune(r)
+	}
+	return cnDigitsRgx.ReplaceAllStringFunc(b.String(), func(s string) string {
+		return strings.Map(func(r rune) rune { return cnDigits[r] }, s)
+	})
+}
+
+// 返回去掉空格后第n个字节在原文中的位置
+func skipSpaces(text string, n int) int {
+	for i := 0; i < len(text); i++ {
+		if text[i] == ' ' {
+			continue
+		}
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(text)
+}
+
+// 匹配用的形式: 去掉标点和空白, 英文小写
+func intentKey(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) || unicode.IsSpace(r) || unicode.IsSymbol(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, NormalizeSpeechText(text))
+}
+
+// 模糊拼音: 不区分平翘舌和前后鼻音
+func fuzzyPinyin(py string) string {
+	for _, p := range [][2]string{{"zh", "z"}, {"ch", "c"}, {"sh", "s"}} {
+		if strings.HasPrefix(py, p[0]) {
+			py = p[1] + py[len(p[0]):]
+		}
+	}
+	if strings.HasSuffix(py, "ng") {
+		py = py[:len(py)-1]
+	}
+	return py
+}
+
+// 每个字转为一个音节, 音节编码为私有区的字符后可以直接用EditDistance按音节比较
+func pinyinString(text string, syllables map[string]rune) string {
+	var b strings.Builder
+	for _, r := range text {
+		py, ok := pinyinOf[r]
+		if !ok {
+			b.WriteRune(r)
+			continue
+		}
+		py = fuzzyPinyin(py)
+		code, ok := syllables[py]
+		if !ok {
+			code = rune(0xe000 + len(syllables))
+			syllables[py] = code
+		}
+		b.WriteRune(code)
+	}
+	return b.String()
+}
+
+// 0-1, 越大越接近
+func intentScore(text string, key string) float64 {
+	if len(key) == 0 {
+		return 0
+	}
+	if text == key {
+		return 1
+	}
+	if strings.Contains(text, key) {
+		return 0.9
+	}
+	syllables := make(map[string]rune)
+	pt, pk := pinyinString(text, syllables), pinyinString(key, syllables)
+	if pt == pk || strings.Contains(pt, pk) {
+		return 0.85
+	}
+	score := 0.0
+	//"把灯打开"包含"开灯"的所有字, 说得越啰嗦分数越低
+	all := true
+	for _, r := range key {
+		if !strings.ContainsRune(text, r) {
+			all = false
+			break
+		}
+	}
+	if all {
+		score = 0.6 + 0.2*float64(len([]rune(key)))/float64(len([]rune(text)))
+	}
+	n := len([]rune(pt))
+	if m := len([]rune(pk)); m > n {
+		n = m
+	}
+	if sim := 0.8 * (1 - float64(EditDistance(pt, pk))/float64(n)); sim > score {
+		score = sim
+	}
+	return score
+}
+
+type IntentCandidate struct {
+	Command string
+	Score   float64
+}
+
+// 匹配结果, Command为空且Candidates多于一个时需要用户选择
+type IntentMatch struct {
+	Command    string
+	Candidates []IntentCandidate
+}
+
+type voiceChoice struct {
+	commands []string
+	expire   time.Time
+}
+
+// 把语音识别的文字匹配到指令, 支持配置的同义说法和号码、短信内容的提取
+type IntentMatcher struct {
+	mu        sync.Mutex
+	phrases   map[string]string
+	threshold float64
+	choices   map[string]voiceChoice
+}
+
+func NewIntentMatcher(config Config) *IntentMatcher {
+	threshold := config.VoiceThreshold
+	if threshold == 0 {
+		threshold = DEFAULT_VOICE_THRESHOLD
+	}
+	m := &IntentMatcher{phrases: make(map[string]string), threshold: threshold, choices: make(map[string]voiceChoice)}
+	for phrase, command := range config.VoiceIntents {
+		m.phrases[intentKey(phrase)] = command
+	}
+	return m
+}
+
+// commands为可以直接执行的指令名或别名到指令的映射
+func (m *IntentMatcher) Match(text string, commands map[string]string) IntentMatch {
+	text = NormalizeSpeechText(text)
+	compact := strings.ReplaceAll(text, " ", "")
+	for _, rgx := range smsIntentRgxs {
+		if g := rgx.FindStringSubmatch(compact); g != nil {
+			//短信内容从原文中取, 保留英文单词之间的空格
+			body := strings.TrimSpace(text[skipSpaces(text, len(compact)-len(g[2])):])
+			return IntentMatch{Command: "sms" + CMD_SEP + g[1] + CMD_SEP + body}
+		}
+	}
+	for _, rgx := range dialIntentRgxs {
+		if g := rgx.FindStringSubmatch(compact); g != nil {
+			return IntentMatch{Command: "dial" + CMD_SEP + g[1]}
+		}
+	}
+
+	key := intentKey(text)
+	if len(key) == 0 || strings.Trim(key, "0123456789") == "" {
+		return IntentMatch{}
+	}
+	best := make(map[string]float64)
+	score := func(k string, command string) {
+		if s := intentScore(key, intentKey(k)); s > best[command] {
+			best[command] = s
+		}
+	}
+	for k, command := range commands {
+		score(k, command)
+	}
+	for k, command := range m.phrases {
+		score(k, command)
+	}
+	var candidates []IntentCandidate
+	for command, s := range best {
+		if s >= m.threshold {
+			candidates = append(candidates, IntentCandidate{Command: command, Score: s})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Command < candidates[j].Command
+	})
+	if len(candidates) == 0 {
+		return IntentMatch{}
+	}
+	//第二名与第一名相差不大时不猜, 让用户选择
+	if len(candidates) == 1 || candidates[0].Score == 1 || candidates[0].Score-candidates[1].Score >= 0.1 {
+		return IntentMatch{Command: candidates[0].Command, Candidates: candidates[:1]}
+	}
+	if len(candidates) > VOICE_MAX_CHOICES {
+		candidates = candidates[:VOICE_MAX_CHOICES]
+	}
+	return IntentMatch{Candidates: candidates}
+}
+
+// 记录候选项并返回询问用户的内容
+func (m *IntentMatcher) Ask(user string, candidates []IntentCandidate) string {
+	var commands []string
+	var lines []string
+	for i, c := range candidates {
+		commands = append(commands, c.Command)
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, c.Command))
+	}
+	m.mu.Lock()
+	m.choices[user] = voiceChoice{commands: commands, expire: time.Now().Add(VOICE_CHOICE_EXPIRE)}
+	m.mu.Unlock()
+	return fmt.Sprintf("没有听清您要执行哪个指令, 请在%d分钟内回复编号:\n%s", int(VOICE_CHOICE_EXPIRE.Minutes()), strings.Join(lines, "\n"))
+}
+
+// 用户回复了候选项的编号时返回对应的指令, 回复其他内容时放弃选择
+func (m *IntentMatcher) Choose(user string, text string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	choice, ok := m.choices[user]
+	if !ok {
+		return "", false
+	}
+	delete(m.choices, user)
+	if time.Now().After(choice.expire) {
+		return "", false
+	}
+	key := intentKey(text)
+	for i, command := range choice.commands {
+		if key == fmt.Sprint(i+1) || key == intentKey(command) {
+			return command, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,359 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_SCRIPT_TIMEOUT uint   = 60
+	DEFAULT_PAGE_SIZE      int    = 2000 //企业微信文本消息最长2048字节
+	MAX_JOB_OUTPUT         int    = 64 * 1024
+	MAX_FINISHED_JOBS      int    = 20
+	DEFAULT_SCRIPT_ENV     string = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+type ScriptParam struct {
+	Name     string `json:"name"`
+	Pattern  string `json:"pattern"`
+	Optional bool   `json:"optional"`
+}
+
+// 允许远程执行的脚本, args中的{name}会被替换为对应的参数
+type Script struct {
+	Path    string        `json:"path"`
+	Args    []string      `json:"args"`
+	Params  []ScriptParam `json:"params"`
+	Timeout uint          `json:"timeout"`
+	Role    string        `json:"role"`
+	Help    string        `json:"help"`
+}
+
+type JobInfo struct {
+	ID        int
+	Name      string
+	User      string
+	Args      []string
+	Started   time.Time
+	Finished  time.Time
+	Running   bool
+	Killed    bool
+	Err       error
+	Truncated bool
+}
+
+type Job struct {
+	JobInfo
+	mu     sync.Mutex
+	output bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (job *Job) Output() string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.output.String()
+}
+
+// 作为命令的stdout和stderr, 超过MAX_JOB_OUTPUT的部分被丢弃
+func (job *Job) Write(p []byte) (int, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	left := MAX_JOB_OUTPUT - job.output.Len()
+	if left <= 0 {
+		job.Truncated = true
+		return len(p), nil
+	}
+	if len(p) > left {
+		job.Truncated = true
+		job.output.Write(p[:left])
+		return len(p), nil
+	}
+	return job.output.Write(p)
+}
+
+type JobRunner struct {
+	mu      sync.Mutex
+	config  Config
+	scripts map[string]Script
+	jobs    map[int]*Job
+	next    int
+}
+
+func NewJobRunner(config Config) *JobRunner {
+	return &JobRunner{config: config, scripts: config.Scripts, jobs: make(map[int]*Job)}
+}
+
+func (r *JobRunner) Script(name string) (Script, bool) {
+	script, ok := r.scripts[name]
+	return script, ok
+}
+
+func (r *JobRunner) Help() string {
+	var names []string
+	for name := range r.scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		script := r.scripts[name]
+		line := name
+		for _, p := range script.Params {
+			if p.Optional {
+				line += " [" + p.Name + "]"
+			} else {
+				line += " <" + p.Name + ">"
+			}
+		}
+		if len(script.Help) > 0 {
+			line += "  " + script.Help
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 将脚本名和参数展开为实际执行的程序和参数, 未在scripts中配置的程序只有allowrawcmd打开时才能执行
+func (r *JobRunner) Resolve(fields []string) (Script, []string, error) {
+	if len(fields) == 0 {
+		return Script{}, nil, errors.New("命令为空")
+	}
+	script, ok := r.scripts[fields[0]]
+	if !ok {
+		if !r.config.AllowRawCmd {
+			return Script{}, nil, fmt.Errorf("未允许执行的命令: %s, 可执行的命令:\n%s", fields[0], r.Help())
+		}
+		return Script{Path: fields[0], Role: "admin"}, fields[1:], nil
+	}
+
+	values := fields[1:]
+	if len(values) > len(script.Params) {
+		return script, nil, fmt.Errorf("%s 参数过多", fields[0])
+	}
+	params := make(map[string]string)
+	for i, p := range script.Params {
+		if i >= len(values) {
+			if p.Optional {
+				params[p.Name] = ""
+				continue
+			}
+			return script, nil, fmt.Errorf("%s 缺少参数 %s", fields[0], p.Name)
+		}
+		if len(p.Pattern) > 0 {
+			rgx, err := regexp.Compile(p.Pattern)
+			if err != nil {
+				return script, nil, fmt.Errorf("%s 参数 %s 规则错误: %v", fields[0], p.Name, err)
+			}
+			if !rgx.MatchString(values[i]) {
+				return script, nil, fmt.Errorf("%s 参数 %s 不合法: %s", fields[0], p.Name, values[i])
+			}
+		}
+		params[p.Name] = values[i]
+	}
+
+	var args []string
+	for _, a := range script.Args {
+		//一次替换, 参数值中的{xxx}不会再被替换
+		replaced := placeholderRgx.ReplaceAllStringFunc(a, func(m string) string {
+			if v, ok := params[m[1:len(m)-1]]; ok {
+				return v
+			}
+			return m
+		})
+		if a != replaced && len(replaced) == 0 {
+			continue
+		}
+		args = append(args, replaced)
+	}
+	return script, args, nil
+}
+
+// 在后台执行命令, 执行结束(包括超时和被kill)后调用done
+func (r *JobRunner) Start(user string, name string, script Script, args []string, done func(info JobInfo, output string)) (JobInfo, error) {
+	timeout := script.Timeout
+	if timeout == 0 {
+		timeout = r.config.ScriptTimeout
+	}
+	if timeout == 0 {
+		timeout = DEFAULT_SCRIPT_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	cmd := exec.CommandContext(ctx, script.Path, args...)
+	cmd.Dir = r.config.ScriptDir
+	cmd.Env = r.config.ScriptEnv
+	if len(cmd.Env) == 0 {
+		cmd.Env = []string{DEFAULT_SCRIPT_ENV}
+	}
+	if err := setProcAttr(cmd, r.config.ScriptUser); err != nil {
+		cancel()
+		return JobInfo{}, err
+	}
+
+	r.mu.Lock()
+	r.next += 1
+	job := &Job{cancel: cancel}
+	job.JobInfo = JobInfo{ID: r.next, Name: name, User: user, Args: args, Started: time.Now(), Running: true}
+	cmd.Stdout = job
+	cmd.Stderr = job
+	if err := cmd.Start(); err != nil {
+		r.mu.Unlock()
+		cancel()
+		return JobInfo{}, err
+	}
+	r.jobs[job.ID] = job
+	info := job.info()
+	r.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		r.mu.Lock()
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("执行超时(%d秒)", timeout)
+		}
+		job.Err = err
+		job.Running = false
+		job.Finished = time.Now()
+		info := job.info()
+		r.prune()
+		r.mu.Unlock()
+		cancel()
+		done(info, job.Output())
+	}()
+	return info, nil
+}
+
+func (job *Job) info() JobInfo {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.JobInfo
+}
+
+// 只保留最近结束的若干个任务, 需要持有锁
+func (r *JobRunner) prune() {
+	var finished []*Job
+	for _, job := range r.jobs {
+		if !job.Running {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= MAX_FINISHED_JOBS {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].ID < finished[j].ID })
+	for _, job := range finished[:len(finished)-MAX_FINISHED_JOBS] {
+		delete(r.jobs, job.ID)
+	}
+}
+
+func (r *JobRunner) Get(id int) (JobInfo, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return JobInfo{}, "", false
+	}
+	return job.info(), job.Output(), true
+}
+
+func (r *JobRunner) List() []JobInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []JobInfo
+	for _, job := range r.jobs {
+		result = append(result, job.info())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+func (r *JobRunner) Kill(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return fmt.Errorf("任务 #%d 不存在", id)
+	}
+	if !job.Running {
+		return fmt.Errorf("任务 #%d 已经结束", id)
+	}
+	job.Killed = true
+	job.cancel()
+	return nil
+}
+
+// 按shell的规则拆分参数, 支持单引号, 双引号和反斜杠转义
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	in_arg := false
+	var quote rune
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			in_arg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			in_arg = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if in_arg {
+				args = append(args, cur.String())
+				cur.Reset()
+				in_arg = false
+			}
+		default:
+			cur.WriteRune(c)
+			in_arg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("引号或转义符未闭合")
+	}
+	if in_arg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// 按字节数分页, 不会截断UTF-8字符
+func Paginate(body string, size int) []string {
+	if size <= 0 {
+		size = DEFAULT_PAGE_SIZE
+	}
+	var pages []string
+	for len(body) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut -= 1
+		}
+		if idx := strings.LastIndex(body[:cut], "\n"); idx > cut/2 {
+			cut = idx + 1
+		}
+		pages = append(pages, body[:cut])
+		body = body[cut:]
+	}
+	if len(body) > 0 || len(pages) == 0 {
+		pages = append(pages, body)
+	}
+	return pages
+}
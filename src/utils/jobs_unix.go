@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// 以独立的进程组执行, 超时或kill时整组结束; 配置了scriptuser时切换到该用户
+func setProcAttr(cmd *exec.Cmd, username string) error {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	if len(username) > 0 {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		attr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	}
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
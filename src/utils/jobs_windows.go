@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func setProcAttr(cmd *exec.Cmd, username string) error {
+	if len(username) > 0 {
+		return errors.New("scriptuser is not supported on windows")
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"utils/atparse"
+)
+
+const (
+	DEFAULT_MODEM_CHECK  uint = 300
+	DEFAULT_SIGNAL_ALERT int  = 8
+)
+
+var regStates = map[int]string{0: "未注册", 1: "已注册", 2: "搜索中", 3: "注册被拒绝", 4: "未知", 5: "已注册(漫游)"}
+
+var (
+	cpinRgx    = regexp.MustCompile(`\+CPIN:\s*([^\r\n]+)`)
+	qnwinfoRgx = regexp.MustCompile(`\+QNWINFO:\s*"([^"]*)","([^"]*)","([^"]*)",(\d+)`)
+)
+
+// 模块、SIM卡和网络的状态, Signal为CSQ的rssi(0-31, 99为未知)
+type ModemStatus struct {
+	Signal   int
+	CREG     string
+	CEREG    string
+	Operator string
+	SIM      string
+	Network  string
+	ICCID    string
+	IMSI     string
+	Number   string
+	PINLeft  int
+	PUKLeft  int
+	Updated  time.Time
+}
+
+func (s ModemStatus) SIMInfo() string {
+	lines := []string{"SIM卡: " + s.SIM, "ICCID: " + s.ICCID, "IMSI: " + s.IMSI, "本机号码: " + s.Number}
+	if s.PINLeft >= 0 {
+		lines = append(lines, fmt.Sprintf("PIN剩余次数: %d, PUK剩余次数: %d", s.PINLeft, s.PUKLeft))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s ModemStatus) signalOK(threshold int) bool {
+	return s.Signal == 99 || s.Signal >= threshold
+}
+
+func (s ModemStatus) String() string {
+	if s.Updated.IsZero() {
+		return "还没有获取到模块状态"
+	}
+	signal := "未知"
+	if s.Signal != 99 {
+		signal = fmt.Sprintf("%d (%d dBm)", s.Signal, -113+2*s.Signal)
+	}
+	lines := []string{
+		"信号: " + signal,
+		"SIM卡: " + s.SIM,
+		"运营商: " + s.Operator,
+		"GSM注册: " + s.CREG,
+		"LTE注册: " + s.CEREG,
+	}
+	if len(s.Network) > 0 {
+		lines = append(lines, "网络: "+s.Network)
+	}
+	lines = append(lines, "更新时间: "+s.Updated.Format("01-02 15:04:05"))
+	return strings.Join(lines, "\n")
+}
+
+// 定时查询模块状态, 注册丢失、SIM卡异常或信号低于阈值时调用alert, 恢复时也会通知
+type ModemMonitor struct {
+	mu        sync.Mutex
+	status    ModemStatus
+	interval  time.Duration
+	threshold int
+	dialect   string
+	alert     func(msg string)
+	simOK     *bool
+	regOK     *bool
+	signalOK  *bool
+}
+
+func NewModemMonitor(config Config, alert func(msg string)) *ModemMonitor {
+	interval := config.ModemCheck
+	if interval == 0 {
+		interval = DEFAULT_MODEM_CHECK
+	}
+	threshold := config.SignalAlert
+	if threshold == 0 {
+		threshold = DEFAULT_SIGNAL_ALERT
+	}
+	return &ModemMonitor{
+		status:    ModemStatus{Signal: 99, CREG: "未知", CEREG: "未知", Operator: "未知", SIM: "未知", ICCID: "未知", IMSI: "未知", Number: "未知", PINLeft: -1, PUKLeft: -1},
+		interval:  time.Duration(interval) * time.Second,
+		threshold: threshold,
+		dialect:   config.Dialect,
+		alert:     alert,
+	}
+}
+
+func (m *ModemMonitor) Status() ModemStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// 把状态查询指令加入指令队列, 结果由ProcessATcmdResult交给Update解析
+func (m *ModemMonitor) Run(input chan PhoneMsg) {
+	cmds := []string{CMD_CPIN, CMD_ICCID, CMD_CIMI, CMD_CSQ, CMD_CREG, CMD_CEREG, CMD_COPS}
+	if m.dialect != DIALECT_SIM900A {
+		cmds = append(cmds, CMD_QNWINFO)
+	}
+	time.Sleep(time.Duration(10) * time.Second)
+	for {
+		for _, cmd := range cmds {
+			input <- PhoneMsg{CmdDelay: 1, ATCmd: []byte(cmd + CMD_LF_CR)}
+		}
+		time.Sleep(m.interval)
+	}
+}
+
+// 只解析状态查询指令的结果, 避免短信内容中的文字被误识别
+func (m *ModemMonitor) Update(cmd string, result string) {
+	if m == nil || result == AT_TIMEOUT_RESULT {
+		return
+	}
+	m.mu.Lock()
+	alerts := m.update(cmd, result)
+	m.mu.Unlock()
+	for _, msg := range alerts {
+		log.Printf("modem: %s", msg)
+		if m.alert != nil {
+			m.alert(msg)
+		}
+	}
+}
+
+// 需要持有锁, 返回需要通知的状态变化
+func (m *ModemMonitor) update(cmd string, result string) []string {
+	var alerts []string
+	s := &m.status
+	switch {
+	case strings.HasPrefix(cmd, CMD_CSQ):
+		if csq, ok := atparse.ParseCSQ(result); ok {
+			s.Signal = csq.RSSI
+			alerts = m.check(alerts, &m.signalOK, s.signalOK(m.threshold), fmt.Sprintf("信号强度过低: %d, 阈值 %d", s.Signal, m.threshold), fmt.Sprintf("信号已恢复: %d", s.Signal))
+		}
+	case strings.HasPrefix(cmd, CMD_CREG), strings.HasPrefix(cmd, CMD_CEREG):
+		for _, reg := range atparse.ParseCREG(result) {
+			state, ok := regStates[reg.Stat]
+			if !ok {
+				state = "未知"
+			}
+			if reg.LTE {
+				s.CEREG = state
+			} else {
+				s.CREG = state
+			}
+		}
+		//CEREG在CREG之后查询, 两种注册状态都更新后再判断; 不支持CEREG的模块只看CREG
+		if strings.HasPrefix(cmd, CMD_CEREG) {
+			registered := strings.HasPrefix(s.CREG, "已注册") || strings.HasPrefix(s.CEREG, "已注册")
+			alerts = m.check(alerts, &m.regOK, registered, "模块未注册到网络: GSM "+s.CREG+", LTE "+s.CEREG, "模块已重新注册到网络")
+		}
+	case strings.HasPrefix(cmd, CMD_COPS):
+		if op, ok := atparse.ParseCOPS(result); ok {
+			s.Operator = "无"
+			if len(op.Name) > 0 {
+				s.Operator = decodeCharset(op.Name)
+			}
+		}
+	case strings.HasPrefix(cmd, CMD_CPIN):
+		if match := cpinRgx.FindStringSubmatch(result); match != nil {
+			s.SIM = strings.TrimSpace(match[1])
+		} else if strings.Contains(result, "ERROR") {
+			s.SIM = "未插入或无法读取"
+		} else {
+			break
+		}
+		alerts = m.check(alerts, &m.simOK, s.SIM == "READY", "SIM卡异常: "+s.SIM, "SIM卡已恢复")
+	case strings.HasPrefix(cmd, CMD_ICCID):
+		if match := crsmRgx.FindStringSubmatch(result); match != nil {
+			iccid := decodeICCID(match[1])
+			//SIM卡被更换时通知, 防止被盗用
+			if s.ICCID != "未知" && s.ICCID != iccid {
+				alerts = append(alerts, fmt.Sprintf("SIM卡已更换: %s -> %s", s.ICCID, iccid))
+			}
+			s.ICCID = iccid
+		}
+	case strings.HasPrefix(cmd, CMD_CIMI):
+		if match := imsiRgx.FindStringSubmatch(result); match != nil {
+			s.IMSI = match[1]
+		}
+	case strings.HasPrefix(cmd, CMD_CNUM):
+		s.Number = "SIM卡中没有保存"
+		if match := cnumRgx.FindStringSubmatch(result); match != nil {
+			s.Number = decodeCharset(match[1])
+		}
+	case strings.HasPrefix(cmd, CMD_QPINC):
+		s.PINLeft, s.PUKLeft = parseQPINC(result)
+	case strings.HasPrefix(cmd, CMD_QNWINFO):
+		if match := qnwinfoRgx.FindStringSubmatch(result); match != nil {
+			s.Network = fmt.Sprintf("%s %s %s", match[1], match[3], match[2])
+		}
+	default:
+		return nil
+	}
+	s.Updated = time.Now()
+	return alerts
+}
+
+// 第一次查询到异常状态或状态发生变化时通知
+func (m *ModemMonitor) check(alerts []string, last **bool, ok bool, bad string, recovered string) []string {
+	if *last != nil && **last == ok {
+		return alerts
+	}
+	if !ok {
+		alerts = append(alerts, bad)
+	} else if *last != nil {
+		alerts = append(alerts, recovered)
+	}
+	*last = &ok
+	return alerts
+}
+
+// 设置了UCS2字符集时运营商名称是十六进制编码
+func decodeCharset(text string) string {
+	if len(text) >= 8 && len(text)%4 == 0 && hexRgx.MatchString(text) {
+		return DecodeUSSD(text, 0x08)
+	}
+	return text
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DIALECT_EC20      string = "ec20"
+	DIALECT_SIM900A   string = "sim900a"
+	CMD_CMGDA_SIM900A string = "AT+CMGDA=\"DEL READ\"" //SIM900A 删除已读短信
+)
+
+// modems中的一个模块, 没有设置的字段使用顶层配置中的值
+type ModemConfig struct {
+	Label      string `json:"label"`
+	Device     string `json:"device"`
+	DeviceUSB  string `json:"deviceusb"`
+	Baudrate   uint   `json:"baudrate"`
+	Dialect    string `json:"dialect"`
+	Number     string `json:"number"`
+	PowerPin   uint   `json:"powerpin"`
+	SIMPin     string `json:"simpin"`
+	SIMPinFile string `json:"simpinfile"`
+}
+
+// 按对方号码选择发送短信和拨号使用的模块, pattern为正则
+type ModemRoute struct {
+	Pattern string `json:"pattern"`
+	Modem   string `json:"modem"`
+}
+
+// 每个模块有自己的指令队列、串口和状态
+type Modem struct {
+	Label     string
+	Number    string
+	Config    Config
+	Tasks     chan PhoneMsg //后台定时查询
+	Urgent    chan PhoneMsg //用户发起的指令, 优先执行
+	Results   chan PhoneMsg
+	Monitor   *ModemMonitor
+	Delivery  *DeliveryTracker
+	Voicemail *Voicemail
+}
+
+func (c ModemConfig) apply(config Config) Config {
+	config.Label = c.Label
+	if len(c.Device) > 0 {
+		config.Device = c.Device
+		config.DeviceUSB = ""
+	}
+	if len(c.DeviceUSB) > 0 {
+		config.DeviceUSB = c.DeviceUSB
+	}
+	if c.Baudrate > 0 {
+		config.Baudrate = c.Baudrate
+	}
+	if len(c.Dialect) > 0 {
+		config.Dialect = c.Dialect
+	}
+	if len(c.Number) > 0 {
+		config.Number = c.Number
+	}
+	if c.PowerPin > 0 {
+		config.ModemPowerPin = c.PowerPin
+	}
+	if len(c.SIMPin) > 0 || len(c.SIMPinFile) > 0 {
+		config.SIMPin = c.SIMPin
+		config.SIMPinFile = c.SIMPinFile
+	}
+	return config
+}
+
+// 没有配置modems时使用顶层的device等配置作为唯一的模块
+func NewModems(config Config, alert func(modem *Modem, msg string)) []*Modem {
+	configs := config.Modems
+	if len(configs) == 0 {
+		configs = []ModemConfig{{Label: config.Label}}
+	}
+	var modems []*Modem
+	labels := make(map[string]bool)
+	for i, c := range configs {
+		if len(configs) > 1 && len(c.Label) == 0 {
+			c.Label = fmt.Sprintf("modem%d", i+1)
+		}
+		if labels[c.Label] {
+			log.Printf("modem label %s duplicated", c.Label)
+			continue
+		}
+		labels[c.Label] = true
+		m := &Modem{
+			Label:    c.Label,
+			Config:   c.apply(config),
+			Tasks:    make(chan PhoneMsg, 100),
+			Urgent:   make(chan PhoneMsg, 100),
+			Results:  make(chan PhoneMsg, 100),
+			Delivery: NewDeliveryTracker(),
+		}
+		m.Number = m.Config.Number
+		m.Monitor = NewModemMonitor(m.Config, func(msg string) { alert(m, msg) })
+		m.Voicemail = NewVoicemail(m)
+		modems = append(modems, m)
+	}
+	return modems
+}
+
+// 以高优先级执行并等待结果, 结果同时交给状态监控解析
+func (m *Modem) Exec(msg PhoneMsg, timeout time.Duration) (PhoneMsg, error) {
+	reply := make(chan PhoneMsg, 1)
+	msg.Reply = reply
+	m.Urgent <- msg
+	select {
+	case result := <-reply:
+		m.Monitor.Update(string(result.ATCmd), result.Result)
+		return result, nil
+	case <-time.After(timeout):
+		return msg, errors.New("模块执行指令超时")
+	}
+}
+
+// 通知中用于区分模块的前缀, 只有一个模块且没有设置label时为空
+func (m *Modem) Tag() string {
+	if len(m.Label) == 0 {
+		return ""
+	}
+	return "[" + m.Label + "] "
+}
+
+func FindModem(modems []*Modem, label string) (*Modem, error) {
+	var labels []string
+	for _, m := range modems {
+		if strings.EqualFold(m.Label, label) {
+			return m, nil
+		}
+		labels = append(labels, m.Label)
+	}
+	return nil, fmt.Errorf("没有名为 %s 的模块, 可选: %s", label, strings.Join(labels, ", "))
+}
+
+// 按modemroutes的顺序匹配对方号码, 都不匹配时使用第一个模块
+func RouteModem(modems []*Modem, routes []ModemRoute, phone string) *Modem {
+	for _, route := range routes {
+		matched, err := regexp.MatchString(route.Pattern, phone)
+		if err != nil {
+			log.Printf("modemroute %s error: %v", route.Pattern, err)
+			continue
+		}
+		if !matched {
+			continue
+		}
+		if m, err := FindModem(modems, route.Modem); err == nil {
+			return m
+		}
+		log.Printf("modemroute %s: unknown modem %s", route.Pattern, route.Modem)
+	}
+	return modems[0]
+}
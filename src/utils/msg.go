@@ -20,6 +20,9 @@ import (
 	"time"
 )
 
+// 获取token失败时的重试间隔
+const TOKEN_RETRY_INTERVAL time.Duration = 30 * time.Second
+
 type WXAccessToken struct {
 	ErrorCode   int    `json:"errorcode"`
 	Errmsg      string `json:"errmsg"`
@@ -39,6 +42,7 @@ type BaiDuAccessToken struct {
 type MSG struct {
 	XMLName      xml.Name `xml:"xml"`
 	ToUserName   string   `xml:"ToUserName,CDATA"`
+	FromUserName string   `xml:"FromUserName,CDATA"`
 	Encrypt      string   `xml:"Encrypt,CDATA"`
 	AgentID      string   `xml:"AgentID,CDATA"`
 	MsgType      string   `xml:"MsgType,CDATA"`
@@ -181,14 +185,17 @@ func GetWXAccessToken(access_token_resp *WXAccessToken, corpid string, corpsecre
 		resp, err := http.Get(wx_access_tokey)
 		if err != nil {
 			log.Println(err)
+			time.Sleep(TOKEN_RETRY_INTERVAL)
+			continue
 		}
 
-		defer resp.Body.Close()
-
 		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		json.Unmarshal(body, access_token_resp)
-		if access_token_resp.ErrorCode != 0 {
+		if access_token_resp.ErrorCode != 0 || access_token_resp.ExpiresIn <= 100 {
 			log.Println(access_token_resp.Errmsg)
+			time.Sleep(TOKEN_RETRY_INTERVAL)
+			continue
 		}
 		time.Sleep(time.Duration(access_token_resp.ExpiresIn-100) * time.Second)
 	}
@@ -201,47 +208,47 @@ func GetBaiDuYuYingAccessToken(access_token_resp *BaiDuAccessToken, apikey strin
 		resp, err := http.Get(baidu_oauth)
 		if err != nil {
 			log.Println(err)
+			time.Sleep(TOKEN_RETRY_INTERVAL)
+			continue
 		}
 
-		defer resp.Body.Close()
-
 		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		json.Unmarshal(body, access_token_resp)
+		if access_token_resp.ExpiresIn <= 100 {
+			log.Printf("get baidu access token error: %s", body)
+			time.Sleep(TOKEN_RETRY_INTERVAL)
+			continue
+		}
 		time.Sleep(time.Duration(access_token_resp.ExpiresIn-100) * time.Second)
 	}
 
 }
 
-func GetWXVoiceBody(wxtoken string, wxmediaid string) (string, int) {
+// 下载企业微信消息中的语音等媒体文件, 失败时企业微信返回JSON格式的错误
+func GetWXMedia(wxtoken string, wxmediaid string) ([]byte, error) {
 	wx_media_url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/get?access_token=%s&media_id=%s", wxtoken, wxmediaid)
 	resp, err := http.Get(wx_media_url)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	return base64.StdEncoding.EncodeToString(body), len(body)
-}
-
-func GetBaiduVoiceResult(voice *BaiDuVoice) BaiDuVoiceResult {
-	var result BaiDuVoiceResult
-	post_data, err := json.Marshal(voice)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	resp, err := http.Post("http://vop.baidu.com/server_api", "application/json", bytes.NewReader(post_data))
-	if err != nil {
-		log.Println(err)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("下载企业微信媒体文件失败: %s", resp.Status)
 	}
-
-	defer resp.Body.Close()
-
-	body, _ := ioutil.ReadAll(resp.Body)
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		log.Println(err)
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		var wxErr struct {
+			ErrCode int    `json:"errcode"`
+			ErrMsg  string `json:"errmsg"`
+		}
+		json.Unmarshal(body, &wxErr)
+		return nil, fmt.Errorf("下载企业微信媒体文件失败: %d %s", wxErr.ErrCode, wxErr.ErrMsg)
 	}
-	return result
+	return body, nil
 }
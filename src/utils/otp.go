@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_OTP_EXPIRE uint = 300
+
+// 内置的验证码规则, 第一个分组为验证码
+var defaultOTPPatterns = []string{
+	`(?:验证码|校验码|动态码|确认码|动态密码|短信密码|安全码|激活码|授权码)\D{0,12}?([0-9]{4,8})`,
+	`([0-9]{4,8})\s*[，,]?\s*(?:是|为)?(?:您|你)?的?(?:本次)?(?:验证码|校验码|动态码|动态密码|登录码)`,
+	`(?:验证码|校验码|动态码)[^0-9A-Za-z]{0,12}?([0-9A-Za-z]{4,8})\b`,
+	`(?i)\b([0-9]{4,8}) is your\b.{0,40}?(?:code|otp|pin|password)`,
+	`(?i)(?:verification|security|login|one[- ]time|auth(?:entication)?)\s*(?:code|pin|password)\D{0,12}?([0-9]{4,8})\b`,
+	`(?i)\b(?:code|otp|passcode)\s*(?:is|:|=)?\s*([0-9]{3}[- ][0-9]{3})\b`,
+	`(?i)\b(?:code|otp|passcode)\s*(?:is|:|=)?\s*([0-9]{4,8})\b`,
+}
+
+var otpServiceRgxs = []*regexp.Regexp{
+	regexp.MustCompile(`【([^】]{1,20})】`),
+	regexp.MustCompile(`^\[([^\]]{1,20})\]`),
+	regexp.MustCompile(`\[([^\]]{1,20})\]$`),
+	regexp.MustCompile(`(?i)\byour ([A-Z][\w.&-]{1,20}) (?:verification |security |login )?(?:code|otp|pin)`),
+	regexp.MustCompile(`(?i)^([A-Z][\w.&-]{1,20}):`),
+	regexp.MustCompile(`(?i)^([A-Z][\w.&-]{1,20}) (?:verification |login )?code\b`),
+}
+
+type OTP struct {
+	Code     string    `json:"code"`
+	Service  string    `json:"service"`
+	Sender   string    `json:"sender"`
+	Received time.Time `json:"received"`
+	Expires  time.Time `json:"expires"`
+}
+
+type OTPExtractor struct {
+	patterns []*regexp.Regexp
+}
+
+// 自定义规则优先于内置规则
+func NewOTPExtractor(custom []string) *OTPExtractor {
+	e := &OTPExtractor{}
+	for _, p := range append(append([]string{}, custom...), defaultOTPPatterns...) {
+		rgx, err := regexp.Compile(p)
+		if err != nil {
+			log.Printf("otp pattern %s error: %v", p, err)
+			continue
+		}
+		e.patterns = append(e.patterns, rgx)
+	}
+	return e
+}
+
+// 返回验证码和发送方服务名称, 没有识别出验证码时ok为false
+func (e *OTPExtractor) Extract(body string) (code string, service string, ok bool) {
+	for _, rgx := range e.patterns {
+		m := rgx.FindStringSubmatch(body)
+		if len(m) > 1 && len(m[1]) > 0 {
+			code = strings.NewReplacer("-", "", " ", "").Replace(m[1])
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return "", "", false
+	}
+	body = strings.TrimSpace(body)
+	for _, rgx := range otpServiceRgxs {
+		if m := rgx.FindStringSubmatch(body); len(m) > 1 {
+			service = strings.TrimSpace(m[1])
+			break
+		}
+	}
+	return code, service, true
+}
+
+// 保存最近收到的验证码, 过期后自动清除
+type OTPStore struct {
+	mu        sync.Mutex
+	extractor *OTPExtractor
+	expire    time.Duration
+	token     string
+	codes     []OTP
+}
+
+func NewOTPStore(config Config) *OTPStore {
+	expire := config.OTPExpire
+	if expire == 0 {
+		expire = DEFAULT_OTP_EXPIRE
+	}
+	return &OTPStore{
+		extractor: NewOTPExtractor(config.OTPPatterns),
+		expire:    time.Duration(expire) * time.Second,
+		token:     config.OTPToken,
+	}
+}
+
+// 识别短信中的验证码并保存, 没有验证码时返回nil
+func (s *OTPStore) Add(sender string, body string) *OTP {
+	if s == nil {
+		return nil
+	}
+	code, service, ok := s.extractor.Extract(body)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	otp := OTP{Code: code, Service: service, Sender: sender, Received: now, Expires: now.Add(s.expire)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	s.codes = append(s.codes, otp)
+	return &otp
+}
+
+// 需要持有锁
+func (s *OTPStore) prune(now time.Time) {
+	var codes []OTP
+	for _, otp := range s.codes {
+		if now.Before(otp.Expires) {
+			codes = append(codes, otp)
+		}
+	}
+	s.codes = codes
+}
+
+// 返回未过期的验证码, 最新的在前; service非空时按服务名或发送号码过滤
+func (s *OTPStore) List(service string) []OTP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	result := []OTP{}
+	for i := len(s.codes) - 1; i >= 0; i-- {
+		otp := s.codes[i]
+		if len(service) == 0 || strings.Contains(strings.ToLower(otp.Service), strings.ToLower(service)) || otp.Sender == service {
+			result = append(result, otp)
+		}
+	}
+	return result
+}
+
+func (s *OTPStore) Consume(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var codes []OTP
+	for _, otp := range s.codes {
+		if otp.Code != code {
+			codes = append(codes, otp)
+		}
+	}
+	s.codes = codes
+}
+
+// GET /otp 返回最新的验证码, all=1返回全部, service=xx按服务过滤, consume=1取出后删除
+func (s *OTPStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(s.token) > 0 && req.Header.Get("Authorization") != "Bearer "+s.token && req.URL.Query().Get("token") != s.token {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	codes := s.List(req.URL.Query().Get("service"))
+	w.Header().Set("Content-Type", "application/json")
+	if len(codes) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{}"))
+		return
+	}
+	var body []byte
+	if req.URL.Query().Get("all") == "1" {
+		body, _ = json.Marshal(codes)
+	} else {
+		body, _ = json.Marshal(codes[0])
+		if req.URL.Query().Get("consume") == "1" {
+			s.Consume(codes[0].Code)
+		}
+	}
+	w.Write(body)
+}
+
+func (s *OTPStore) Listen(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/otp", s)
+	server := &http.Server{Addr: addr, Handler: mux}
+	log.Println(server.ListenAndServe())
+}
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BanEvent struct {
+	IP       string    `json:"ip"`
+	Failures uint      `json:"failures"`
+	BannedAt time.Time `json:"bannedat"`
+	Until    time.Time `json:"until"`
+}
+
+// 签名校验失败的次数, 超过FAIL_WINDOW没有再失败时清零
+type failRecord struct {
+	count uint
+	last  time.Time
+}
+
+const FAIL_WINDOW time.Duration = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 按IP做令牌桶限速, 签名校验连续失败达到上限后临时封禁
+type IPGuard struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	maxFail  uint
+	banTime  time.Duration
+	allow    []*net.IPNet
+	buckets  map[string]*tokenBucket
+	failures map[string]*failRecord
+	bans     map[string]BanEvent
+	events   []BanEvent
+}
+
+func NewIPGuard(config Config) *IPGuard {
+	guard := &IPGuard{
+		rate:     config.RateLimit,
+		burst:    float64(config.RateBurst),
+		maxFail:  config.MaxFailures,
+		banTime:  time.Duration(config.BanTime) * time.Second,
+		buckets:  make(map[string]*tokenBucket),
+		failures: make(map[string]*failRecord),
+		bans:     make(map[string]BanEvent),
+	}
+	if guard.burst < 1 {
+		guard.burst = 1
+	}
+	for _, item := range config.AllowIPs {
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Printf("allowips %s error: %v", item, err)
+			continue
+		}
+		guard.allow = append(guard.allow, ipnet)
+	}
+	return guard
+}
+
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (guard *IPGuard) Allowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ipnet := range guard.allow {
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回false表示该IP已被封禁或超出限速, 请求不应再被处理
+func (guard *IPGuard) Allow(ip string) bool {
+	if guard.Allowed(ip) {
+		return true
+	}
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	now := time.Now()
+	if ban, ok := guard.bans[ip]; ok {
+		if now.Before(ban.Until) {
+			return false
+		}
+		delete(guard.bans, ip)
+	}
+	if guard.rate <= 0 {
+		return true
+	}
+	bucket, ok := guard.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: guard.burst, last: now}
+		guard.buckets[ip] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * guard.rate
+	if bucket.tokens > guard.burst {
+		bucket.tokens = guard.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+func (guard *IPGuard) Fail(ip string) {
+	if guard.maxFail == 0 || guard.Allowed(ip) {
+		return
+	}
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	now := time.Now()
+	record, ok := guard.failures[ip]
+	if !ok || now.Sub(record.last) > FAIL_WINDOW {
+		record = &failRecord{}
+		guard.failures[ip] = record
+	}
+	record.count += 1
+	record.last = now
+	if record.count < guard.maxFail {
+		return
+	}
+	ban := BanEvent{IP: ip, Failures: record.count, BannedAt: now, Until: now.Add(guard.banTime)}
+	guard.bans[ip] = ban
+	guard.events = append(guard.events, ban)
+	if len(guard.events) > 100 {
+		guard.events = guard.events[len(guard.events)-100:]
+	}
+	delete(guard.failures, ip)
+	log.Printf("ban %s until %s after %d failures", ip, ban.Until.Format("2006-01-02 15:04:05"), ban.Failures)
+}
+
+func (guard *IPGuard) Success(ip string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	delete(guard.failures, ip)
+}
+
+// 清理已经恢复满额的令牌桶、过期的失败记录和封禁, 防止map无限增长
+func (guard *IPGuard) Cleanup() {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	now := time.Now()
+	for ip, bucket := range guard.buckets {
+		if now.Sub(bucket.last).Seconds()*guard.rate >= guard.burst {
+			delete(guard.buckets, ip)
+		}
+	}
+	for ip, record := range guard.failures {
+		if now.Sub(record.last) > FAIL_WINDOW {
+			delete(guard.failures, ip)
+		}
+	}
+	for ip, ban := range guard.bans {
+		if now.After(ban.Until) {
+			delete(guard.bans, ip)
+		}
+	}
+}
+
+func (guard *IPGuard) Bans() []BanEvent {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	result := []BanEvent{}
+	now := time.Now()
+	for _, ban := range guard.bans {
+		if now.Before(ban.Until) {
+			result = append(result, ban)
+		}
+	}
+	return result
+}
+
+func (guard *IPGuard) Events() []BanEvent {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	return append([]BanEvent{}, guard.events...)
+}
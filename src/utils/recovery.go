@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	CMD_AT              string        = "AT"
+	CMD_CFUN_RESET      string        = "AT+CFUN=1,1" //重启模块
+	AT_TIMEOUT_RESULT   string        = "ERROR: timeout"
+	MODEM_MAX_TIMEOUTS  int           = 3
+	MODEM_SOFT_RESETS   int           = 2
+	MODEM_RESET_WAIT    time.Duration = 15 * time.Second
+	MODEM_WAIT_NOTIFY   time.Duration = time.Minute
+	DEFAULT_ERROR_SLEEP uint          = 5
+)
+
+func sleepOnError(config Config) {
+	sleep := config.ErrorSleep
+	if sleep == 0 {
+		sleep = DEFAULT_ERROR_SLEEP
+	}
+	time.Sleep(time.Duration(sleep) * time.Second)
+}
+
+// 等待设备文件出现, 配置了deviceusb时按USB的VID:PID查找对应的ttyUSB, 开机或者模块重新枚举后设备号可能变化
+func WaitDevice(config Config, notify func(msg string)) string {
+	start := time.Now()
+	notified := false
+	for {
+		device := config.Device
+		if len(config.DeviceUSB) > 0 {
+			var err error
+			if device, err = FindUSBSerial(config.DeviceUSB); err != nil {
+				device = ""
+			}
+		}
+		if len(device) > 0 {
+			if _, err := os.Stat(device); err == nil {
+				if notified {
+					notify("设备已出现: " + device)
+				}
+				return device
+			}
+		}
+		if !notified && time.Since(start) > MODEM_WAIT_NOTIFY {
+			notify(fmt.Sprintf("等待设备 %s%s 超过%v", config.Device, config.DeviceUSB, MODEM_WAIT_NOTIFY))
+			notified = true
+		}
+		time.Sleep(time.Duration(1) * time.Second)
+	}
+}
+
+// usb格式为 VID:PID 或 VID:PID:接口号, 如EC20的AT口为 2c7c:0125:3
+func FindUSBSerial(usb string) (string, error) {
+	parts := strings.Split(strings.ToLower(usb), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", fmt.Errorf("deviceusb格式应为 VID:PID[:接口号]: %s", usb)
+	}
+	ttys, _ := filepath.Glob("/sys/class/tty/ttyUSB*")
+	acms, _ := filepath.Glob("/sys/class/tty/ttyACM*")
+	for _, tty := range append(ttys, acms...) {
+		dev, err := filepath.EvalSymlinks(filepath.Join(tty, "device"))
+		if err != nil {
+			continue
+		}
+		//ttyUSB的device指向接口下的ttyUSBx目录, ttyACM直接指向接口目录
+		iface := dev
+		if strings.HasPrefix(filepath.Base(dev), "tty") {
+			iface = filepath.Dir(dev)
+		}
+		usbdev := filepath.Dir(iface)
+		if readSysfs(filepath.Join(usbdev, "idVendor")) != parts[0] || readSysfs(filepath.Join(usbdev, "idProduct")) != parts[1] {
+			continue
+		}
+		if len(parts) == 3 && strings.TrimLeft(readSysfs(filepath.Join(iface, "bInterfaceNumber")), "0") != strings.TrimLeft(parts[2], "0") {
+			continue
+		}
+		return "/dev/" + filepath.Base(tty), nil
+	}
+	return "", fmt.Errorf("没有找到USB设备 %s", usb)
+}
+
+func readSysfs(path string) string {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(string(body)))
+}
+
+// 确认模块可以响应AT指令, 并设置短信为文本模式、来电上报号码; 字符集平时保持UCS2, 需要其他字符集的指令执行后会恢复
+func InitModem(port io.ReadWriteCloser) error {
+	for i := 0; i < MODEM_MAX_TIMEOUTS; i++ {
+		msg := PhoneMsg{ATCmd: []byte(CMD_AT + CMD_LF_CR)}
+		if err := execOnce(port, &msg); err != nil {
+			return err
+		}
+		if strings.Contains(msg.Result, "OK") {
+			for _, cmd := range []string{CMD_CMGF, CMD_CSCS_UCS2, CMD_CNMI_DS, CMD_CLIP} {
+				msg = PhoneMsg{ATCmd: []byte(cmd + CMD_LF_CR)}
+				if err := execOnce(port, &msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return errors.New("模块无响应")
+}
+
+// 前几次通过 AT+CFUN=1,1 软重启模块, 仍然失败时调用powerCycle断电重启
+func ResetModem(port io.ReadWriteCloser, resets int, powerCycle func()) {
+	if resets > MODEM_SOFT_RESETS && powerCycle != nil {
+		log.Printf("modem power cycle, resets: %d", resets)
+		powerCycle()
+	} else {
+		log.Printf("modem soft reset, resets: %d", resets)
+		port.Write([]byte(CMD_CFUN_RESET + CMD_LF_CR))
+	}
+	time.Sleep(MODEM_RESET_WAIT)
+}
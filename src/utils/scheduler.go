@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MIN_SCHEDULE_EVERY time.Duration = time.Minute
+
+// 配置文件中的定时任务
+type ScheduleConfig struct {
+	Cron    string `json:"cron"`
+	Every   string `json:"every"`
+	Command string `json:"command"`
+	User    string `json:"user"`
+}
+
+// cron, every, at 三者只会设置其中之一, at为一次性任务
+type ScheduleJob struct {
+	ID      int       `json:"id"`
+	Cron    string    `json:"cron,omitempty"`
+	Every   string    `json:"every,omitempty"`
+	At      time.Time `json:"at"`
+	Command string    `json:"command"`
+	User    string    `json:"user"`
+	Next    time.Time `json:"next"`
+	Static  bool      `json:"-"`
+
+	cron  *CronExpr
+	every time.Duration
+}
+
+func (job *ScheduleJob) Describe() string {
+	var when string
+	switch {
+	case len(job.Cron) > 0:
+		when = "cron " + job.Cron
+	case len(job.Every) > 0:
+		when = "每隔 " + job.Every
+	default:
+		when = "在 " + job.At.Format("2006-01-02 15:04")
+	}
+	desc := fmt.Sprintf("#%d %s 执行 %s, 下次: %s", job.ID, when, job.Command, job.Next.Format("01-02 15:04"))
+	if job.Static {
+		desc += " (配置文件)"
+	}
+	return desc
+}
+
+func (job *ScheduleJob) prepare() error {
+	var err error
+	switch {
+	case len(job.Cron) > 0:
+		job.cron, err = ParseCron(job.Cron)
+	case len(job.Every) > 0:
+		job.every, err = ParseEvery(job.Every)
+	case job.At.IsZero():
+		err = errors.New("定时任务缺少cron, every或at")
+	}
+	if err == nil && len(strings.TrimSpace(job.Command)) == 0 {
+		err = errors.New("定时任务缺少command")
+	}
+	return err
+}
+
+// 计算now之后的下一次执行时间, 一次性任务执行过后返回零值
+func (job *ScheduleJob) next(now time.Time) time.Time {
+	switch {
+	case job.cron != nil:
+		return job.cron.Next(now)
+	case job.every > 0:
+		if job.Next.IsZero() {
+			return now.Add(job.every)
+		}
+		next := job.Next
+		for !next.After(now) {
+			next = next.Add(job.every)
+		}
+		return next
+	case job.Next.IsZero():
+		return job.At
+	}
+	return time.Time{}
+}
+
+// 支持 30m, 1h30m 这样的Go时长写法, 以及 d/天/小时/分钟 单位
+func ParseEvery(every string) (time.Duration, error) {
+	s := strings.NewReplacer("天", "d", "小时", "h", "分钟", "m", "分", "m", "秒", "s").Replace(strings.TrimSpace(every))
+	var days time.Duration
+	if idx := strings.Index(s, "d"); idx > 0 {
+		var n int
+		if _, err := fmt.Sscanf(s[:idx], "%d", &n); err != nil {
+			return 0, fmt.Errorf("间隔有误: %s", every)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		s = s[idx+1:]
+	}
+	d := time.Duration(0)
+	if len(s) > 0 {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("间隔有误: %s", every)
+		}
+	}
+	d += days
+	if d < MIN_SCHEDULE_EVERY {
+		return 0, fmt.Errorf("间隔不能小于%v: %s", MIN_SCHEDULE_EVERY, every)
+	}
+	return d, nil
+}
+
+// 支持 08:00, 10-20 08:00, 2006-01-02 08:00; 只有时间时取下一个到达的时刻
+func ParseAt(at string, now time.Time) (time.Time, error) {
+	at = strings.TrimSpace(strings.Replace(at, "：", ":", -1))
+	if t, err := time.ParseInLocation("15:04", at, now.Location()); err == nil {
+		result := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !result.After(now) {
+			result = result.AddDate(0, 0, 1)
+		}
+		return result, nil
+	}
+	if t, err := time.ParseInLocation("01-02 15:04", at, now.Location()); err == nil {
+		result := time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !result.After(now) {
+			result = result.AddDate(1, 0, 0)
+		}
+		return result, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", at, now.Location()); err == nil {
+		if !t.After(now) {
+			return t, fmt.Errorf("时间已经过去: %s", at)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("时间格式有误: %s, 应为 08:00 或 2006-01-02 08:00", at)
+}
+
+type Scheduler struct {
+	mu   sync.Mutex
+	jobs map[int]*ScheduleJob
+	next int
+	file string
+	run  func(job ScheduleJob)
+}
+
+// 加载schedulefile中保存的任务以及配置文件中的任务, 到期时调用run
+// 保存的任务沿用原来的编号, 配置文件中的任务和新任务的编号从最大编号之后开始
+func NewScheduler(config Config, run func(job ScheduleJob)) *Scheduler {
+	s := &Scheduler{jobs: make(map[int]*ScheduleJob), file: config.ScheduleFile, run: run}
+	now := time.Now()
+	var pending []*ScheduleJob
+	for _, job := range loadScheduleFile(s.file) {
+		if err := job.prepare(); err != nil {
+			log.Printf("schedule #%d error: %v", job.ID, err)
+			continue
+		}
+		// 停机期间错过的一次性任务在启动后立即执行
+		if job.cron != nil {
+			job.Next = job.next(now)
+		} else if job.every > 0 && job.Next.Before(now) {
+			job.Next = now
+		}
+		if _, dup := s.jobs[job.ID]; job.ID <= 0 || dup {
+			pending = append(pending, job)
+			continue
+		}
+		s.jobs[job.ID] = job
+		if job.ID > s.next {
+			s.next = job.ID
+		}
+	}
+	//旧版本保存的文件中编号可能重复
+	for _, job := range pending {
+		s.next += 1
+		job.ID = s.next
+		s.jobs[job.ID] = job
+	}
+	for _, c := range config.Schedules {
+		job := &ScheduleJob{Cron: c.Cron, Every: c.Every, Command: c.Command, User: c.User, Static: true}
+		if err := job.prepare(); err != nil {
+			log.Printf("schedule %s error: %v", c.Command, err)
+			continue
+		}
+		s.next += 1
+		job.ID = s.next
+		job.Next = job.next(now)
+		s.jobs[job.ID] = job
+	}
+	if len(pending) > 0 {
+		s.save()
+	}
+	return s
+}
+
+func loadScheduleFile(file string) []*ScheduleJob {
+	if len(file) == 0 {
+		return nil
+	}
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("read %s error: %v", file, err)
+		}
+		return nil
+	}
+	var saved []*ScheduleJob
+	if err := json.Unmarshal(body, &saved); err != nil {
+		log.Printf("parse %s error: %v", file, err)
+		return nil
+	}
+	return saved
+}
+
+// 需要持有锁
+func (s *Scheduler) save() {
+	if len(s.file) == 0 {
+		return
+	}
+	var saved []*ScheduleJob
+	for _, job := range s.jobs {
+		if !job.Static {
+			saved = append(saved, job)
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	body, _ := json.MarshalIndent(saved, "", "  ")
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		log.Printf("write %s error: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		log.Printf("rename %s error: %v", tmp, err)
+	}
+}
+
+func (s *Scheduler) Add(job ScheduleJob) (ScheduleJob, error) {
+	if err := job.prepare(); err != nil {
+		return job, err
+	}
+	job.Static = false
+	job.Next = time.Time{}
+	job.Next = job.next(time.Now())
+	if job.Next.IsZero() {
+		return job, errors.New("无法计算下次执行时间")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next += 1
+	job.ID = s.next
+	s.jobs[job.ID] = &job
+	s.save()
+	return job, nil
+}
+
+// 只有任务的创建者或all为true(管理员)时才能取消, 配置文件中的任务不能取消
+func (s *Scheduler) Cancel(id int, user string, all bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || (!all && job.User != user) {
+		return fmt.Errorf("定时任务 #%d 不存在", id)
+	}
+	if job.Static {
+		return fmt.Errorf("定时任务 #%d 来自配置文件, 不能取消", id)
+	}
+	delete(s.jobs, id)
+	s.save()
+	return nil
+}
+
+func (s *Scheduler) List(user string, all bool) []ScheduleJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []ScheduleJob
+	for _, job := range s.jobs {
+		if all || job.User == user {
+			result = append(result, *job)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// 每秒检查一次到期的任务
+func (s *Scheduler) Run() {
+	for {
+		time.Sleep(time.Duration(1) * time.Second)
+		now := time.Now()
+		var due []ScheduleJob
+		s.mu.Lock()
+		changed := false
+		for id, job := range s.jobs {
+			if job.Next.IsZero() || job.Next.After(now) {
+				continue
+			}
+			due = append(due, *job)
+			job.Next = job.next(now)
+			if job.Next.IsZero() {
+				delete(s.jobs, id)
+			}
+			changed = changed || !job.Static
+		}
+		if changed {
+			s.save()
+		}
+		s.mu.Unlock()
+		for _, job := range due {
+			log.Printf("schedule #%d run %s", job.ID, job.Command)
+			s.run(job)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SENSOR_THERMAL string = "thermal" //sysfs中的thermal_zone
+	SENSOR_DS18B20 string = "ds18b20" //1-Wire温度传感器, 需要 dtoverlay=w1-gpio
+	SENSOR_DHT     string = "dht"     //DHT11/22, 需要 dtoverlay=dht11,gpiopin=<GPIO>, 由内核驱动按时序读取
+	SENSOR_HTTP    string = "http"    //返回JSON的HTTP接口, 如ESP8266
+
+	W1_DEVICES              string        = "/sys/bus/w1/devices"
+	IIO_DEVICES             string        = "/sys/bus/iio/devices"
+	DEFAULT_SENSOR_INTERVAL uint          = 60
+	DEFAULT_SENSOR_HISTORY  int           = 1440 //每个值保存的记录数, 按默认间隔为一天
+	DEFAULT_SENSOR_WINDOW   time.Duration = 24 * time.Hour
+	DHT_RETRIES             int           = 3
+)
+
+// values中键为记录的名称, http传感器的值为jsonpath, dht传感器的值为temp或humi;
+// thermal和ds18b20只有一个值, 以name记录
+type SensorConfig struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	File     string            `json:"file"`
+	URL      string            `json:"url"`
+	Values   map[string]string `json:"values"`
+	Interval uint              `json:"interval"`
+	Timeout  uint              `json:"timeout"`
+}
+
+// 高于above或低于below时通知, 回到阈值hysteresis以内时通知恢复; above和below可以只设置一个
+type SensorAlert struct {
+	Name       string   `json:"name"`
+	Above      *float64 `json:"above"`
+	Below      *float64 `json:"below"`
+	Hysteresis float64  `json:"hysteresis"`
+}
+
+// 一次读取的所有值, 键为记录的名称
+type Sensor interface {
+	Read() (map[string]float64, error)
+}
+
+func NewSensor(c SensorConfig) (Sensor, error) {
+	switch c.Type {
+	case SENSOR_THERMAL:
+		file := c.File
+		if len(file) == 0 {
+			file = DEFAULT_THERMAL_FILE
+		}
+		return &thermalSensor{name: c.Name, file: file}, nil
+	case SENSOR_DS18B20:
+		return &ds18b20Sensor{name: c.Name, file: c.File}, nil
+	case SENSOR_DHT:
+		values := c.Values
+		if len(values) == 0 {
+			values = map[string]string{"temp": "temp", "humi": "humi"}
+		}
+		for name, field := range values {
+			if field != "temp" && field != "humi" {
+				return nil, fmt.Errorf("传感器 %s 的 %s 应为 temp 或 humi", c.Name, name)
+			}
+		}
+		return &dhtSensor{dir: c.File, values: values}, nil
+	case SENSOR_HTTP:
+		if len(c.URL) == 0 || len(c.Values) == 0 {
+			return nil, fmt.Errorf("传感器 %s 需要配置url和values", c.Name)
+		}
+		timeout := c.Timeout
+		if timeout == 0 {
+			timeout = DEFAULT_HTTP_TIMEOUT
+		}
+		return &httpSensor{url: c.URL, values: c.Values, client: &http.Client{Timeout: time.Duration(timeout) * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("传感器 %s 的类型未知: %s, 可选: %s, %s, %s, %s", c.Name, c.Type, SENSOR_THERMAL, SENSOR_DS18B20, SENSOR_DHT, SENSOR_HTTP)
+}
+
+// 传感器记录的所有名称及按类型推断的单位, http传感器没有单位
+func sensorUnits(c SensorConfig) map[string]string {
+	units := make(map[string]string)
+	switch c.Type {
+	case SENSOR_THERMAL, SENSOR_DS18B20:
+		units[c.Name] = "°C"
+	case SENSOR_DHT:
+		for name, field := range c.Values {
+			if field == "humi" {
+				units[name] = "%"
+			} else {
+				units[name] = "°C"
+			}
+		}
+		if len(c.Values) == 0 {
+			units["temp"], units["humi"] = "°C", "%"
+		}
+	case SENSOR_HTTP:
+		for name := range c.Values {
+			units[name] = ""
+		}
+	}
+	return units
+}
+
+type thermalSensor struct {
+	name string
+	file string
+}
+
+func (s *thermalSensor) Read() (map[string]float64, error) {
+	temp, err := ReadTemp(s.file)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{s.name: temp}, nil
+}
+
+// file可以是w1_slave的路径或设备ID(28-xxxx), 为空时使用找到的第一个DS18B20
+type ds18b20Sensor struct {
+	name string
+	file string
+}
+
+func (s *ds18b20Sensor) Read() (map[string]float64, error) {
+	file := s.file
+	if len(file) == 0 {
+		matches, _ := filepath.Glob(filepath.Join(W1_DEVICES, "28-*", "w1_slave"))
+		if len(matches) == 0 {
+			return nil, errors.New("没有找到DS18B20")
+		}
+		file = matches[0]
+	} else if !strings.Contains(file, "/") {
+		file = filepath.Join(W1_DEVICES, file, "w1_slave")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	//第一行以YES结尾表示CRC校验通过, 第二行 t=23125 为毫摄氏度
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) < 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return nil, errors.New("DS18B20校验失败")
+	}
+	idx := strings.Index(lines[1], "t=")
+	if idx < 0 {
+		return nil, errors.New("DS18B20没有温度数据")
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][idx+2:]))
+	if err != nil {
+		return nil, err
+	}
+	//85度是上电后的默认值, 表示还没有完成转换
+	if milli == 85000 {
+		return nil, errors.New("DS18B20尚未完成温度转换")
+	}
+	return map[string]float64{s.name: float64(milli) / 1000}, nil
+}
+
+// 通过内核的dht11驱动(IIO)读取, dir为空时使用找到的第一个dht11设备
+// 单线时序经常被打断, 读取失败时隔2秒重试(DHT两次读取至少间隔2秒)
+type dhtSensor struct {
+	dir    string
+	values map[string]string
+}
+
+func (s *dhtSensor) Read() (map[string]float64, error) {
+	dir := s.dir
+	if len(dir) == 0 {
+		names, _ := filepath.Glob(filepath.Join(IIO_DEVICES, "*", "name"))
+		for _, name := range names {
+			if content, err := ioutil.ReadFile(name); err == nil && strings.HasPrefix(string(content), "dht11") {
+				dir = filepath.Dir(name)
+				break
+			}
+		}
+		if len(dir) == 0 {
+			return nil, errors.New("没有找到DHT设备, 请检查 dtoverlay=dht11")
+		}
+	}
+	files := map[string]string{"temp": "in_temp_input", "humi": "in_humidityrelative_input"}
+	var err error
+	for i := 0; i < DHT_RETRIES; i++ {
+		if i > 0 {
+			time.Sleep(2 * time.Second)
+		}
+		result := make(map[string]float64)
+		for name, field := range s.values {
+			var content []byte
+			if content, err = ioutil.ReadFile(filepath.Join(dir, files[field])); err != nil {
+				break
+			}
+			var milli int
+			if milli, err = strconv.Atoi(strings.TrimSpace(string(content))); err != nil {
+				break
+			}
+			result[name] = float64(milli) / 1000
+		}
+		if err == nil {
+			return result, nil
+		}
+	}
+	return nil, err
+}
+
+type httpSensor struct {
+	url    string
+	values map[string]string
+	client *http.Client
+}
+
+// 数值可以是数字或数字字符串
+func (s *httpSensor) Read() (map[string]float64, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("请求失败: %s", resp.Status)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("返回的不是JSON: %v", err)
+	}
+	result := make(map[string]float64)
+	for name, path := range s.values {
+		value, err := JSONPath(doc, path)
+		if err != nil {
+			return nil, fmt.Errorf("提取 %s 失败: %v", name, err)
+		}
+		switch v := value.(type) {
+		case float64:
+			result[name] = v
+		case string:
+			if result[name], err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return nil, fmt.Errorf("%s 不是数字: %s", name, v)
+			}
+		default:
+			return nil, fmt.Errorf("%s 不是数字: %v", name, value)
+		}
+	}
+	return result, nil
+}
+
+type SensorPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// 固定容量的环形缓冲区, 写满后覆盖最早的记录
+type sensorHistory struct {
+	unit   string
+	points []SensorPoint
+	next   int
+	full   bool
+}
+
+func (h *sensorHistory) add(p SensorPoint) {
+	h.points[h.next] = p
+	h.next = (h.next + 1) % len(h.points)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// 按时间顺序返回since之后的记录
+func (h *sensorHistory) since(since time.Time) []SensorPoint {
+	var all []SensorPoint
+	if h.full {
+		all = append(all, h.points[h.next:]...)
+	}
+	all = append(all, h.points[:h.next]...)
+	i := sort.Search(len(all), func(i int) bool { return !all[i].Time.Before(since) })
+	return all[i:]
+}
+
+type SensorStats struct {
+	Name    string
+	Unit    string
+	Window  time.Duration
+	Count   int
+	Last    SensorPoint
+	Min     SensorPoint
+	Max     SensorPoint
+	Average float64
+}
+
+func (s SensorStats) String() string {
+	return fmt.Sprintf("%s 最近%s (%d条记录)\n当前: %.1f%s (%s)\n最低: %.1f%s (%s)\n最高: %.1f%s (%s)\n平均: %.1f%s",
+		s.Name, strings.TrimSuffix(strings.TrimSuffix(s.Window.String(), "0s"), "0m"), s.Count,
+		s.Last.Value, s.Unit, s.Last.Time.Format("01-02 15:04"),
+		s.Min.Value, s.Unit, s.Min.Time.Format("01-02 15:04"),
+		s.Max.Value, s.Unit, s.Max.Time.Format("01-02 15:04"),
+		s.Average, s.Unit)
+}
+
+type sensorAlertState struct {
+	SensorAlert
+	state int //1高于above, -1低于below
+}
+
+// 按各自的间隔读取所有传感器, 保存历史并检查阈值
+type SensorHub struct {
+	mu      sync.Mutex
+	configs []SensorConfig
+	sensors []Sensor
+	size    int
+	history map[string]*sensorHistory
+	alerts  map[string][]*sensorAlertState
+	alert   func(msg string)
+}
+
+func NewSensorHub(config Config, alert func(msg string)) (*SensorHub, error) {
+	h := &SensorHub{
+		size:    config.SensorHistory,
+		history: make(map[string]*sensorHistory),
+		alerts:  make(map[string][]*sensorAlertState),
+		alert:   alert,
+	}
+	if h.size <= 0 {
+		h.size = DEFAULT_SENSOR_HISTORY
+	}
+	for _, c := range config.Sensors {
+		if len(c.Name) == 0 {
+			return nil, errors.New("传感器需要配置name")
+		}
+		s, err := NewSensor(c)
+		if err != nil {
+			return nil, err
+		}
+		h.configs = append(h.configs, c)
+		h.sensors = append(h.sensors, s)
+		for name, unit := range sensorUnits(c) {
+			h.history[name] = &sensorHistory{unit: unit, points: make([]SensorPoint, h.size)}
+		}
+	}
+	for _, a := range config.SensorAlerts {
+		h.alerts[a.Name] = append(h.alerts[a.Name], &sensorAlertState{SensorAlert: a})
+	}
+	return h, nil
+}
+
+func (h *SensorHub) Run() {
+	for i := range h.sensors {
+		go h.poll(h.configs[i], h.sensors[i])
+	}
+}
+
+// 连续读取失败只通知一次, 恢复后再通知
+func (h *SensorHub) poll(c SensorConfig, s Sensor) {
+	interval := c.Interval
+	if interval == 0 {
+		interval = DEFAULT_SENSOR_INTERVAL
+	}
+	failed := false
+	for {
+		values, err := s.Read()
+		if err != nil {
+			log.Printf("sensor %s: %v", c.Name, err)
+			if !failed {
+				h.notify(fmt.Sprintf("传感器 %s 读取失败: %v", c.Name, err))
+			}
+			failed = true
+		} else {
+			if failed {
+				h.notify("传感器 " + c.Name + " 已恢复")
+			}
+			failed = false
+			now := time.Now()
+			for name, value := range values {
+				h.Record(name, SensorPoint{Time: now, Value: value})
+			}
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+func (h *SensorHub) notify(msg string) {
+	if h.alert != nil {
+		h.alert(msg)
+	}
+}
+
+// 保存一条记录并检查阈值
+func (h *SensorHub) Record(name string, p SensorPoint) {
+	h.mu.Lock()
+	hist, ok := h.history[name]
+	if !ok {
+		hist = &sensorHistory{points: make([]SensorPoint, h.size)}
+		h.history[name] = hist
+	}
+	hist.add(p)
+	var msgs []string
+	for _, a := range h.alerts[name] {
+		if msg := a.check(p.Value, hist.unit); len(msg) > 0 {
+			msgs = append(msgs, name+" "+msg)
+		}
+	}
+	h.mu.Unlock()
+	for _, msg := range msgs {
+		h.notify(msg)
+	}
+}
+
+func (a *sensorAlertState) check(value float64, unit string) string {
+	switch {
+	case a.state != 1 && a.Above != nil && value > *a.Above:
+		a.state = 1
+		return fmt.Sprintf("%.1f%s 高于 %.1f%s", value, unit, *a.Above, unit)
+	case a.state != -1 && a.Below != nil && value < *a.Below:
+		a.state = -1
+		return fmt.Sprintf("%.1f%s 低于 %.1f%s", value, unit, *a.Below, unit)
+	case a.state == 1 && value <= *a.Above-a.Hysteresis, a.state == -1 && value >= *a.Below+a.Hysteresis:
+		a.state = 0
+		return fmt.Sprintf("已恢复正常: %.1f%s", value, unit)
+	}
+	return ""
+}
+
+func (h *SensorHub) Stats(name string, window time.Duration) (SensorStats, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.history[name]
+	if !ok {
+		return SensorStats{}, fmt.Errorf("没有名为 %s 的传感器数据, 可选: %s", name, strings.Join(h.names(), ", "))
+	}
+	points := hist.since(time.Now().Add(-window))
+	if len(points) == 0 {
+		return SensorStats{}, fmt.Errorf("%s 最近%s没有记录", name, window)
+	}
+	stats := SensorStats{Name: name, Unit: hist.unit, Window: window, Count: len(points)}
+	stats.Min, stats.Max, stats.Last = points[0], points[0], points[len(points)-1]
+	sum := 0.0
+	for _, p := range points {
+		if p.Value < stats.Min.Value {
+			stats.Min = p
+		}
+		if p.Value > stats.Max.Value {
+			stats.Max = p
+		}
+		sum += p.Value
+	}
+	stats.Average = sum / float64(len(points))
+	return stats, nil
+}
+
+// 所有值的最新记录
+func (h *SensorHub) Summary() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var lines []string
+	for _, name := range h.names() {
+		hist := h.history[name]
+		points := hist.since(time.Time{})
+		if len(points) == 0 {
+			lines = append(lines, name+": 暂无数据")
+			continue
+		}
+		last := points[len(points)-1]
+		lines = append(lines, fmt.Sprintf("%s: %.1f%s (%s)", name, last.Value, hist.unit, last.Time.Format("01-02 15:04")))
+	}
+	if len(lines) == 0 {
+		return "没有配置传感器"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 调用时需要持有锁
+func (h *SensorHub) names() []string {
+	var names []string
+	for name := range h.history {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CMD_CPIN_SET  string        = "AT+CPIN=\""               //输入PIN 后跟PIN
+	CMD_CPWD      string        = "AT+CPWD=\"SC\",\""        //修改PIN 后跟 旧PIN","新PIN
+	CMD_QPINC     string        = "AT+QPINC=\"SC\""          //EC20 查询PIN/PUK剩余次数
+	CMD_CIMI      string        = "AT+CIMI"                  //IMSI
+	CMD_ICCID     string        = "AT+CRSM=176,12258,0,0,10" //从SIM卡的EF_ICCID文件读取ICCID
+	CMD_CNUM      string        = "AT+CNUM"                  //本机号码
+	CMD_CPBS      string        = "AT+CPBS=\"SM\""           //选择SIM卡通讯录
+	CMD_CPBR      string        = "AT+CPBR="                 //读取通讯录 后跟 起始,结束
+	MIN_PIN_TRIES int           = 2                          //剩余次数少于该值时不自动解锁, 防止锁卡
+	SIM_INIT_WAIT time.Duration = time.Duration(5) * time.Second
+
+	DEFAULT_SIMLOCK_FILE string = "./gsm-simlock.failed"
+)
+
+var (
+	pinRgx   = regexp.MustCompile(`^[0-9]{4,8}$`)
+	qpincRgx = regexp.MustCompile(`\+QPINC:\s*"SC",\s*(\d+),\s*(\d+)`)
+	imsiRgx  = regexp.MustCompile(`(?m)^\s*([0-9]{14,15})\s*$`)
+	crsmRgx  = regexp.MustCompile(`\+CRSM:\s*144,\s*0,\s*"?([0-9A-Fa-f]+)"?`)
+	cnumRgx  = regexp.MustCompile(`\+CNUM:\s*"[^"]*",\s*"([^"]+)"`)
+	cpbrRgx  = regexp.MustCompile(`\+CPBR:\s*(\d+),\s*"([^"]*)",\s*\d+,\s*"([^"]*)"`)
+)
+
+func IsPIN(pin string) bool {
+	return pinRgx.MatchString(pin)
+}
+
+// 开机或模块重置后自动输入PIN, 输错一次后不再自动尝试, 只能通过pin指令手动解锁
+// 失败状态保存在simlockfile中, 程序或模块重启后不会再次尝试; SIM900A无法查询剩余次数, 全靠这个文件防止锁卡
+type SIMLock struct {
+	pin  string
+	file string
+}
+
+// 多个模块时按label区分
+func SIMLockFile(config Config) string {
+	file := config.SIMLockFile
+	if len(file) == 0 {
+		file = DEFAULT_SIMLOCK_FILE
+	}
+	if len(config.Label) > 0 {
+		file += "." + config.Label
+	}
+	return file
+}
+
+// 手动解锁成功后清除失败状态, 之后可以再次自动解锁
+func ClearSIMLockFailure(config Config) {
+	if err := os.Remove(SIMLockFile(config)); err != nil && !os.IsNotExist(err) {
+		log.Printf("remove %s error: %v", SIMLockFile(config), err)
+	}
+}
+
+func (l *SIMLock) failed() bool {
+	_, err := os.Stat(l.file)
+	return err == nil
+}
+
+// simpinfile优先于simpin, 避免把PIN写在配置文件中
+func NewSIMLock(config Config) *SIMLock {
+	l := &SIMLock{pin: config.SIMPin, file: SIMLockFile(config)}
+	if len(config.SIMPinFile) > 0 {
+		body, err := ioutil.ReadFile(config.SIMPinFile)
+		if err != nil {
+			log.Printf("read %s error: %v", config.SIMPinFile, err)
+		} else {
+			l.pin = strings.TrimSpace(string(body))
+		}
+	}
+	if len(l.pin) > 0 && !IsPIN(l.pin) {
+		log.Printf("simpin should be 4-8 digits")
+		l.pin = ""
+	}
+	return l
+}
+
+// 返回PIN和PUK的剩余次数, 模块不支持查询时为-1
+func PINAttempts(port io.ReadWriteCloser) (int, int) {
+	msg := PhoneMsg{ATCmd: []byte(CMD_QPINC + CMD_LF_CR)}
+	if err := execOnce(port, &msg); err != nil {
+		return -1, -1
+	}
+	return parseQPINC(msg.Result)
+}
+
+func parseQPINC(result string) (int, int) {
+	m := qpincRgx.FindStringSubmatch(result)
+	if m == nil {
+		return -1, -1
+	}
+	pin, _ := strconv.Atoi(m[1])
+	puk, _ := strconv.Atoi(m[2])
+	return pin, puk
+}
+
+// SIM卡需要PIN时自动解锁, 无法解锁时只通知, 不影响其他指令的执行
+func (l *SIMLock) Unlock(port io.ReadWriteCloser, notify func(msg string)) {
+	msg := PhoneMsg{ATCmd: []byte(CMD_CPIN + CMD_LF_CR)}
+	if err := execOnce(port, &msg); err != nil {
+		return
+	}
+	m := cpinRgx.FindStringSubmatch(msg.Result)
+	if m == nil {
+		return
+	}
+	state := strings.TrimSpace(m[1])
+	switch state {
+	case "READY":
+		return
+	case "SIM PIN":
+	case "SIM PUK":
+		notify("SIM卡已被PUK锁定, 需要使用PUK码解锁")
+		return
+	default:
+		notify("SIM卡状态: " + state)
+		return
+	}
+	left, _ := PINAttempts(port)
+	switch {
+	case len(l.pin) == 0:
+		notify(fmt.Sprintf("SIM卡需要PIN, 没有配置simpin, 请使用 pin::<PIN> 解锁, 剩余次数: %d", left))
+		return
+	case l.failed():
+		notify(fmt.Sprintf("SIM卡需要PIN, 上次自动解锁失败或被中断(%s), 请使用 pin::<PIN> 解锁, 剩余次数: %d", l.file, left))
+		return
+	case left >= 0 && left < MIN_PIN_TRIES:
+		notify(fmt.Sprintf("SIM卡PIN剩余次数只有%d次, 为防止锁卡不再自动解锁, 请确认PIN后使用 pin::<PIN> 解锁", left))
+		return
+	}
+	//先记录为失败, 输入过程中程序或模块重启也不会再次尝试
+	if err := ioutil.WriteFile(l.file, []byte(time.Now().Format("2006-01-02 15:04:05")+" auto unlock\n"), 0600); err != nil {
+		notify(fmt.Sprintf("无法保存自动解锁状态(%v), 为防止锁卡不自动解锁, 请使用 pin::<PIN> 解锁", err))
+		return
+	}
+	msg = PhoneMsg{ATCmd: []byte(CMD_CPIN_SET + l.pin + "\"" + CMD_LF_CR)}
+	if err := execOnce(port, &msg); err != nil {
+		return
+	}
+	if !strings.Contains(msg.Result, "OK") {
+		left, _ = PINAttempts(port)
+		notify(fmt.Sprintf("SIM卡PIN错误, 剩余次数: %d", left))
+		return
+	}
+	os.Remove(l.file)
+	log.Printf("sim unlocked")
+	notify("SIM卡已解锁")
+	time.Sleep(SIM_INIT_WAIT)
+}
+
+// EF_ICCID中每个字节的两个数字是反序存放的, 末尾的F为填充
+func decodeICCID(raw string) string {
+	b := []byte(strings.ToUpper(raw))
+	for i := 0; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = b[i+1], b[i]
+	}
+	return strings.TrimRight(string(b), "F")
+}
+
+// 格式化SIM卡相关指令的结果, 不是这些指令时ok为false
+func FormatSIMResult(cmd string, result string) (string, bool) {
+	success := strings.Contains(result, "OK") && !strings.Contains(result, "ERROR")
+	switch {
+	case strings.HasPrefix(cmd, CMD_CPIN_SET):
+		if success {
+			return "SIM卡PIN验证成功", true
+		}
+		return "SIM卡PIN验证失败", true
+	case strings.HasPrefix(cmd, CMD_CPWD):
+		if success {
+			return "SIM卡PIN已修改", true
+		}
+		return "修改PIN失败, 请检查旧PIN是否正确", true
+	case strings.HasPrefix(cmd, CMD_CPBR):
+		var lines []string
+		for _, m := range cpbrRgx.FindAllStringSubmatch(result, -1) {
+			lines = append(lines, fmt.Sprintf("%s. %s %s", m[1], decodeCharset(m[3]), decodeCharset(m[2])))
+		}
+		if len(lines) == 0 {
+			return "SIM卡通讯录中没有记录", true
+		}
+		return "SIM卡通讯录:\n" + strings.Join(lines, "\n"), true
+	}
+	return "", false
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SMS_CONTROL_MAX_FAILURES int           = 5
+	SMS_CONTROL_LOCK_TIME    time.Duration = time.Hour
+	TOTP_PERIOD              int64         = 30
+	TOTP_DIGITS              int           = 6
+	TOTP_MIN_KEY_SIZE        int           = 10 //RFC 4226要求密钥至少128位, 这里至少80位
+)
+
+// 教程和RFC中的示例密钥, 任何人都能算出口令
+var exampleTOTPSecrets = []string{
+	"JBSWY3DPEHPK3PXP",
+	"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+}
+
+// 短信控制通道: 白名单号码发来的 "<PIN或TOTP> <指令>" 格式的短信按指令执行
+type SMSControl struct {
+	mu       sync.Mutex
+	numbers  map[string]string
+	pin      string
+	totp     []byte
+	counters map[string]int64
+	failures map[string]int
+	locked   map[string]time.Time
+}
+
+func NewSMSControl(config Config) *SMSControl {
+	c := &SMSControl{
+		numbers:  make(map[string]string),
+		pin:      config.SMSPin,
+		counters: make(map[string]int64),
+		failures: make(map[string]int),
+		locked:   make(map[string]time.Time),
+	}
+	for number, user := range config.SMSControl {
+		c.numbers[NormalizePhone(number)] = user
+	}
+	if len(config.SMSTOTP) > 0 {
+		secret := strings.ToUpper(strings.ReplaceAll(config.SMSTOTP, " ", ""))
+		key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+		switch {
+		case err != nil:
+			log.Printf("smstotp error: %v", err)
+		case isExampleTOTP(secret):
+			log.Printf("smstotp is a well-known example secret, sms control by totp disabled")
+		case len(key) < TOTP_MIN_KEY_SIZE:
+			log.Printf("smstotp is too short, need at least %d bytes", TOTP_MIN_KEY_SIZE)
+		default:
+			c.totp = key
+		}
+	}
+	return c
+}
+
+func isExampleTOTP(secret string) bool {
+	for _, example := range exampleTOTPSecrets {
+		if strings.TrimRight(secret, "=") == example {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SMSControl) Enabled() bool {
+	return len(c.numbers) > 0 && (len(c.pin) > 0 || len(c.totp) > 0)
+}
+
+func TOTPCode(key []byte, counter int64) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%mod)
+}
+
+// 允许前后一个周期的时间误差, 同一个号码不能重复使用已经用过的TOTP
+func (c *SMSControl) checkTOTP(number string, code string, now time.Time) bool {
+	if len(c.totp) == 0 || len(code) != TOTP_DIGITS {
+		return false
+	}
+	counter := now.Unix() / TOTP_PERIOD
+	for _, n := range []int64{counter - 1, counter, counter + 1} {
+		if n <= c.counters[number] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(TOTPCode(c.totp, n)), []byte(code)) == 1 {
+			c.counters[number] = n
+			return true
+		}
+	}
+	return false
+}
+
+// 口令的长度与pin相同或为TOTP_DIGITS位数字
+func (c *SMSControl) looksLikeCode(code string) bool {
+	if len(c.pin) > 0 && len(code) == len(c.pin) {
+		return true
+	}
+	return len(c.totp) > 0 && len(code) == TOTP_DIGITS && strings.Trim(code, "0123456789") == ""
+}
+
+// 不是白名单号码发来的短信, 或第一个词不像口令时返回空的user且err为nil, 按普通短信处理;
+// 白名单号码的短信校验失败时返回err, 连续失败多次后该号码被锁定一段时间
+func (c *SMSControl) Check(sms SMS) (user string, command string, err error) {
+	number := NormalizePhone(sms.Sender)
+	user, ok := c.numbers[number]
+	if !ok {
+		return "", "", nil
+	}
+	body := strings.TrimSpace(sms.Body)
+	fields := strings.SplitN(body, " ", 2)
+	code := strings.TrimSpace(fields[0])
+	if !c.looksLikeCode(code) {
+		return "", "", nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if until, ok := c.locked[number]; ok && now.Before(until) {
+		return "", "", fmt.Errorf("号码 %s 校验失败次数过多, 锁定到 %s", sms.Sender, until.Format("15:04"))
+	}
+	if len(fields) != 2 || len(strings.TrimSpace(fields[1])) == 0 {
+		return "", "", errors.New("格式应为: <口令> <指令>")
+	}
+	pin_ok := len(c.pin) > 0 && subtle.ConstantTimeCompare([]byte(code), []byte(c.pin)) == 1
+	if !pin_ok && !c.checkTOTP(number, code, now) {
+		c.failures[number] += 1
+		if c.failures[number] >= SMS_CONTROL_MAX_FAILURES {
+			c.locked[number] = now.Add(SMS_CONTROL_LOCK_TIME)
+			delete(c.failures, number)
+		}
+		return "", "", fmt.Errorf("号码 %s 口令错误", sms.Sender)
+	}
+	delete(c.failures, number)
+	return user, strings.TrimSpace(fields[1]), nil
+}
+
+// 按短信长度拆分回复, UCS2编码的单条短信最多70个字符
+func SplitSMS(body string, size int, max int) []string {
+	runes := []rune(strings.TrimSpace(body))
+	var parts []string
+	for len(runes) > 0 && len(parts) < max {
+		n := size
+		if n > len(runes) {
+			n = len(runes)
+		}
+		parts = append(parts, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return parts
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_RULE_RATELIMIT uint = 3600
+
+// 收到的一条短信
+type SMS struct {
+	Sender string `json:"sender"`
+	Time   string `json:"time"`
+	Body   string `json:"body"`
+	Modem  string `json:"modem"`
+}
+
+// 短信规则, sender/keyword/regex都为空时匹配所有短信; reply中的{sender}会被替换为发送号码
+type SMSRule struct {
+	Name      string   `json:"name"`
+	Sender    string   `json:"sender"`
+	Senders   []string `json:"senders"`
+	Unknown   bool     `json:"unknown"`
+	Keyword   string   `json:"keyword"`
+	Regex     string   `json:"regex"`
+	Away      bool     `json:"away"`
+	Reply     string   `json:"reply"`
+	Action    string   `json:"action"`
+	User      string   `json:"user"`
+	Webhook   string   `json:"webhook"`
+	RateLimit uint     `json:"ratelimit"`
+	Stop      bool     `json:"stop"`
+
+	sender *regexp.Regexp
+	regex  *regexp.Regexp
+}
+
+type SMSRules struct {
+	mu       sync.Mutex
+	rules    []*SMSRule
+	contacts map[string]bool
+	away     bool
+	last     map[string]time.Time
+}
+
+// 去掉国家码和分隔符, 便于比较号码
+func NormalizePhone(phone string) string {
+	phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(phone)
+	phone = strings.TrimPrefix(phone, "+86")
+	if strings.HasPrefix(phone, "0086") {
+		phone = phone[4:]
+	}
+	return phone
+}
+
+func NewSMSRules(config Config) *SMSRules {
+	r := &SMSRules{contacts: make(map[string]bool), away: config.AwayMode, last: make(map[string]time.Time)}
+	for _, c := range config.Contacts {
+		r.contacts[NormalizePhone(c)] = true
+	}
+	for i := range config.SMSRules {
+		rule := config.SMSRules[i]
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		var err error
+		if len(rule.Sender) > 0 {
+			if rule.sender, err = regexp.Compile(rule.Sender); err != nil {
+				log.Printf("smsrule %s sender error: %v", rule.Name, err)
+				continue
+			}
+		}
+		if len(rule.Regex) > 0 {
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				log.Printf("smsrule %s regex error: %v", rule.Name, err)
+				continue
+			}
+		}
+		if rule.RateLimit == 0 {
+			rule.RateLimit = DEFAULT_RULE_RATELIMIT
+		}
+		r.rules = append(r.rules, &rule)
+	}
+	return r
+}
+
+// 加载指令后检查规则中的action, 不能执行的action被清除, 规则的其他动作仍然有效
+func (r *SMSRules) CheckActions(check func(rule SMSRule) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rule := range r.rules {
+		if len(rule.Action) == 0 {
+			continue
+		}
+		if err := check(*rule); err != nil {
+			log.Printf("smsrule %s action %s disabled: %v", rule.Name, rule.Action, err)
+			rule.Action = ""
+		}
+	}
+}
+
+func (r *SMSRules) SetAway(away bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.away = away
+}
+
+func (r *SMSRules) Away() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.away
+}
+
+func (r *SMSRules) IsContact(phone string) bool {
+	return r.contacts[NormalizePhone(phone)]
+}
+
+func (rule *SMSRule) match(sms SMS, contact bool) bool {
+	if rule.sender != nil && !rule.sender.MatchString(sms.Sender) {
+		return false
+	}
+	if len(rule.Senders) > 0 {
+		found := false
+		for _, s := range rule.Senders {
+			if NormalizePhone(s) == NormalizePhone(sms.Sender) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.Unknown && contact {
+		return false
+	}
+	if len(rule.Keyword) > 0 && !strings.Contains(sms.Body, rule.Keyword) {
+		return false
+	}
+	if rule.regex != nil && !rule.regex.MatchString(sms.Body) {
+		return false
+	}
+	return true
+}
+
+// 返回需要执行的规则, 同一号码触发同一规则的间隔小于ratelimit秒时跳过, 防止自动回复互相循环
+func (r *SMSRules) Match(sms SMS) []SMSRule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []SMSRule
+	contact := r.contacts[NormalizePhone(sms.Sender)]
+	now := time.Now()
+	for _, rule := range r.rules {
+		if rule.Away && !r.away {
+			continue
+		}
+		if !rule.match(sms, contact) {
+			continue
+		}
+		key := rule.Name + "|" + NormalizePhone(sms.Sender)
+		if last, ok := r.last[key]; ok && now.Sub(last) < time.Duration(rule.RateLimit)*time.Second {
+			log.Printf("smsrule %s skip %s: rate limited", rule.Name, sms.Sender)
+		} else {
+			r.last[key] = now
+			result = append(result, *rule)
+		}
+		if rule.Stop {
+			break
+		}
+	}
+	return result
+}
+
+func (rule *SMSRule) ReplyText(sms SMS) string {
+	return strings.ReplaceAll(rule.Reply, "{sender}", sms.Sender)
+}
+
+func PostWebhook(url string, rule string, sms SMS) error {
+	body, _ := json.Marshal(map[string]string{"rule": rule, "sender": sms.Sender, "time": sms.Time, "body": sms.Body, "modem": sms.Modem})
+	client := &http.Client{Timeout: time.Duration(DEFAULT_HTTP_TIMEOUT) * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("webhook %s: %s", url, resp.Status)
+	}
+	return nil
+}
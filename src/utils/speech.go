@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SPEECH_BAIDU           string = "baidu"   //百度语音识别, 需要bdyykey和bdyysecret
+	SPEECH_WHISPER         string = "whisper" //局域网内的whisper.cpp server
+	SPEECH_HTTP            string = "http"    //通用HTTP接口, 如包装了Vosk的本地服务
+	DEFAULT_SPEECH_RATE    int    = 16000     //转码后的采样率, 多数识别模型需要16k
+	DEFAULT_BAIDU_DEVPID   int    = 1537      //普通话(支持简单的英文识别)
+	DEFAULT_SPEECH_LANG    string = "zh"
+	DEFAULT_SPEECH_TIMEOUT uint   = 30
+)
+
+type SpeechResult struct {
+	Text         string
+	Confidence   float64 //0-1, 为0表示识别后端没有返回置信度
+	Alternatives []string
+}
+
+type SpeechRecognizer interface {
+	Name() string
+	Recognize(audio Audio) (SpeechResult, error)
+}
+
+// 置信度未知时视为可信
+func (r SpeechResult) Confident(min float64) bool {
+	return r.Confidence == 0 || r.Confidence >= min
+}
+
+func (r SpeechResult) Summary() string {
+	summary := r.Text
+	if r.Confidence > 0 {
+		summary += fmt.Sprintf(" (置信度%.2f)", r.Confidence)
+	}
+	if len(r.Alternatives) > 0 {
+		summary += "\n其他可能: " + strings.Join(r.Alternatives, " / ")
+	}
+	return summary
+}
+
+// 识别结果末尾的句号等标点会导致指令匹配不上
+func normalizeSpeech(text string) string {
+	return strings.TrimRight(strings.TrimSpace(text), "。．.！!？?，,、 ")
+}
+
+func NewSpeechRecognizer(config Config, baiduToken func() string) (SpeechRecognizer, error) {
+	timeout := config.SpeechTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_SPEECH_TIMEOUT
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+	switch config.SpeechBackend {
+	case "", SPEECH_BAIDU:
+		devPid := DEFAULT_BAIDU_DEVPID
+		if len(config.SpeechModel) > 0 {
+			pid, err := strconv.Atoi(config.SpeechModel)
+			if err != nil {
+				return nil, fmt.Errorf("百度语音识别的speechmodel应为dev_pid数字: %s", config.SpeechModel)
+			}
+			devPid = pid
+		}
+		return &BaiduRecognizer{Cuid: config.BaiDuYuYingCuid, DevPid: devPid, Token: baiduToken, client: client}, nil
+	case SPEECH_WHISPER, SPEECH_HTTP:
+		if len(config.SpeechURL) == 0 {
+			return nil, fmt.Errorf("speechbackend %s 需要配置speechurl", config.SpeechBackend)
+		}
+		lang := config.SpeechModel
+		if len(lang) == 0 {
+			lang = DEFAULT_SPEECH_LANG
+		}
+		r := &HTTPRecognizer{URL: config.SpeechURL, Language: lang, Token: config.SpeechToken, client: client}
+		r.whisper = config.SpeechBackend == SPEECH_WHISPER
+		return r, nil
+	}
+	return nil, fmt.Errorf("未知的speechbackend: %s, 可选: %s, %s, %s", config.SpeechBackend, SPEECH_BAIDU, SPEECH_WHISPER, SPEECH_HTTP)
+}
+
+type BaiduRecognizer struct {
+	Cuid   string
+	DevPid int
+	Token  func() string
+	client *http.Client
+}
+
+func (r *BaiduRecognizer) Name() string {
+	return SPEECH_BAIDU
+}
+
+// 百度支持pcm、wav、amr和m4a, 采样率为16000或8000
+func (r *BaiduRecognizer) Recognize(audio Audio) (SpeechResult, error) {
+	var result SpeechResult
+	token := r.Token()
+	if len(token) == 0 {
+		return result, errors.New("百度语音识别的access token尚未获取")
+	}
+	voice := BaiDuVoice{
+		Format:  audio.Format,
+		Rate:    audioRate(audio),
+		Channel: 1,
+		Cuid:    r.Cuid,
+		DevPid:  r.DevPid,
+		Token:   token,
+		Speech:  base64.StdEncoding.EncodeToString(audio.Data),
+		Len:     len(audio.Data),
+	}
+	post_data, err := json.Marshal(voice)
+	if err != nil {
+		return result, err
+	}
+	body, err := speechPost(r.client, "http://vop.baidu.com/server_api", "application/json", post_data, "")
+	if err != nil {
+		return result, err
+	}
+	var bdResult BaiDuVoiceResult
+	if err := json.Unmarshal(body, &bdResult); err != nil {
+		return result, fmt.Errorf("百度语音识别返回的不是JSON: %v", err)
+	}
+	if bdResult.ErrNo != 0 {
+		return result, fmt.Errorf("百度语音识别失败: %d %s", bdResult.ErrNo, bdResult.ErrMsg)
+	}
+	if len(bdResult.Result) == 0 {
+		return result, errors.New("百度语音识别没有结果")
+	}
+	result.Text = normalizeSpeech(bdResult.Result[0])
+	for _, alt := range bdResult.Result[1:] {
+		result.Alternatives = append(result.Alternatives, normalizeSpeech(alt))
+	}
+	return result, nil
+}
+
+// whisper为true时按whisper.cpp server的/inference接口以表单上传, 否则直接POST音频
+type HTTPRecognizer struct {
+	URL      string
+	Language string
+	Token    string
+	whisper  bool
+	client   *http.Client
+}
+
+// 通用接口返回 {"text": "", "confidence": 0.9, "alternatives": [{"text": "", "confidence": 0.5}]}
+// 也兼容Vosk在设置了max_alternatives时只返回alternatives的格式, 以及whisper.cpp的 {"text": ""}
+type httpSpeechResult struct {
+	Text         string  `json:"text"`
+	Confidence   float64 `json:"confidence"`
+	Error        string  `json:"error"`
+	Alternatives []struct {
+		Text       string  `json:"text"`
+		Confidence float64 `json:"confidence"`
+	} `json:"alternatives"`
+}
+
+func (r *HTTPRecognizer) Name() string {
+	if r.whisper {
+		return SPEECH_WHISPER
+	}
+	return SPEECH_HTTP
+}
+
+func (r *HTTPRecognizer) Recognize(audio Audio) (SpeechResult, error) {
+	var result SpeechResult
+	var body []byte
+	var err error
+	if r.whisper {
+		var form bytes.Buffer
+		w := multipart.NewWriter(&form)
+		part, perr := w.CreateFormFile("file", "voice."+audio.Format)
+		if perr != nil {
+			return result, perr
+		}
+		part.Write(audio.Data)
+		w.WriteField("response_format", "json")
+		w.WriteField("language", r.Language)
+		w.WriteField("temperature", "0.0")
+		w.Close()
+		body, err = speechPost(r.client, r.URL, w.FormDataContentType(), form.Bytes(), r.Token)
+	} else {
+		query := url.Values{"lang": {r.Language}, "rate": {strconv.Itoa(audioRate(audio))}, "format": {audio.Format}}
+		target := r.URL
+		if strings.Contains(target, "?") {
+			target += "&" + query.Encode()
+		} else {
+			target += "?" + query.Encode()
+		}
+		body, err = speechPost(r.client, target, "audio/"+audio.Format, audio.Data, r.Token)
+	}
+	if err != nil {
+		return result, err
+	}
+	var hr httpSpeechResult
+	if err := json.Unmarshal(body, &hr); err != nil {
+		return result, fmt.Errorf("语音识别返回的不是JSON: %v", err)
+	}
+	if len(hr.Error) > 0 {
+		return result, fmt.Errorf("语音识别失败: %s", hr.Error)
+	}
+	result.Text, result.Confidence = normalizeSpeech(hr.Text), hr.Confidence
+	for _, alt := range hr.Alternatives {
+		text := normalizeSpeech(alt.Text)
+		if len(result.Text) == 0 {
+			result.Text, result.Confidence = text, alt.Confidence
+		} else if len(text) > 0 && text != result.Text {
+			result.Alternatives = append(result.Alternatives, text)
+		}
+	}
+	if len(result.Text) == 0 {
+		return result, errors.New("语音识别没有结果")
+	}
+	return result, nil
+}
+
+// 没有转码且无法从文件头得到采样率时按默认值
+func audioRate(audio Audio) int {
+	if audio.Rate > 0 {
+		return audio.Rate
+	}
+	return DEFAULT_SPEECH_RATE
+}
+
+func speechPost(client *http.Client, target string, contentType string, data []byte, token string) ([]byte, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("语音识别请求失败: %s", resp.Status)
+	}
+	return body, nil
+}
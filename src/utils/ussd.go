@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"encoding/hex"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"utils/atparse"
+)
+
+const (
+	USSD_DONE             int    = 0 //会话结束
+	USSD_CONTINUE         int    = 1 //需要继续回复菜单选项
+	USSD_CLOSED           int    = 2 //网络结束了会话
+	USSD_TIMEOUT          uint   = 20
+	DEFAULT_BALANCE_REGEX string = `余额[^0-9-]{0,12}(-?[0-9]+(?:\.[0-9]+)?)`
+)
+
+// GSM 03.38 默认字母表和扩展表
+var gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+var gsm7Ext = map[byte]rune{0x0a: '\f', 0x14: '^', 0x28: '{', 0x29: '}', 0x2f: '\\', 0x3c: '[', 0x3d: '~', 0x3e: ']', 0x40: '|', 0x65: '€'}
+
+var hexRgx = regexp.MustCompile(`^[[:xdigit:]]+$`)
+
+type USSDReply struct {
+	Status int
+	Text   string
+}
+
+// 解析模块返回的 +CUSD: <m>,"<str>",<dcs>, 没有USSD结果时ok为false
+func ParseCUSD(result string) (reply USSDReply, ok bool) {
+	cusd, ok := atparse.ParseCUSD(result)
+	if !ok {
+		return reply, false
+	}
+	reply.Status = cusd.Status
+	reply.Text = DecodeUSSD(cusd.Text, cusd.DCS)
+	return reply, true
+}
+
+// dcs为UCS2时按UCS2十六进制解码; 为GSM-7且内容是十六进制时按7位压缩编码解码, 否则模块已经转换为文本
+func DecodeUSSD(text string, dcs int) string {
+	text = strings.TrimSpace(text)
+	if !hexRgx.MatchString(text) || len(text)%2 != 0 {
+		return text
+	}
+	data, _ := hex.DecodeString(text)
+	if dcs&0x0c == 0x08 || dcs == 0x11 {
+		if s, err := Ucs2ToUtf8(string(data)); err == nil {
+			return s
+		}
+		return text
+	}
+	if len(text) >= 8 {
+		if s, ok := unpackGSM7(data); ok {
+			return s
+		}
+	}
+	return text
+}
+
+// 解压7位编码, 出现不可见字符时认为不是GSM-7编码
+func unpackGSM7(data []byte) (string, bool) {
+	n := len(data) * 8 / 7
+	septets := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		bit := i * 7
+		idx, shift := bit/8, uint(bit%8)
+		v := data[idx] >> shift
+		if shift > 1 && idx+1 < len(data) {
+			v |= data[idx+1] << (8 - shift)
+		}
+		septets = append(septets, v&0x7f)
+	}
+	var b strings.Builder
+	for i := 0; i < len(septets); i++ {
+		c := septets[i]
+		if c == 0x1b && i+1 < len(septets) {
+			i++
+			if r, ok := gsm7Ext[septets[i]]; ok {
+				b.WriteRune(r)
+				continue
+			}
+			return "", false
+		}
+		r := gsm7Basic[c]
+		if r == 0x1b {
+			return "", false
+		}
+		b.WriteRune(r)
+	}
+	//末尾用于补齐的CR或@
+	return strings.TrimRight(b.String(), "\r@"), true
+}
+
+func FormatUSSD(reply USSDReply) string {
+	result := "USSD: " + reply.Text
+	switch reply.Status {
+	case USSD_CONTINUE:
+		result += "\n回复 ussd::<选项> 继续, ussd::cancel 结束会话"
+	case USSD_CLOSED:
+		result += "\n会话已被网络结束"
+	}
+	if reply.Status > USSD_CLOSED {
+		result = "USSD查询失败"
+	}
+	return result
+}
+
+// 按正则的第一个分组解析余额, 没有配置正则时使用内置规则
+func ParseBalance(text string, pattern string) (float64, bool) {
+	if len(pattern) == 0 {
+		pattern = DEFAULT_BALANCE_REGEX
+	}
+	rgx, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("balanceregex error: %v", err)
+		return 0, false
+	}
+	m := rgx.FindStringSubmatch(text)
+	if len(m) < 2 {
+		return 0, false
+	}
+	balance, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return balance, true
+}
@@ -0,0 +1,333 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"utils/atparse"
+)
+
+const (
+	CMD_CLIP   string = "AT+CLIP=1"  //来电时上报号码
+	CMD_ATA    string = "ATA"        //接听
+	CMD_QAUDRD string = "AT+QAUDRD=" //EC20 通话录音: <开始1/停止0>,<文件名>,<格式3为AMR>,<1为录制对方的声音>
+	CMD_QFDWL  string = "AT+QFDWL="  //EC20 从模块的文件系统下载文件, 内容为二进制
+	CMD_QFDEL  string = "AT+QFDEL="  //EC20 删除模块上的文件
+
+	RECORD_QAUDRD string = "qaudrd"
+	RECORD_PCM    string = "pcm"
+
+	VOICEMAIL_MODEM_FILE       string        = "RAM:voicemail.amr"
+	DEFAULT_VOICEMAIL_GREETING string        = "您好, 机主暂时无法接听, 请在提示音后留言"
+	DEFAULT_VOICEMAIL_SECONDS  uint          = 60
+	DEFAULT_VOICEMAIL_DIR      string        = "voicemail"
+	VOICEMAIL_RING_PERIOD      time.Duration = 5 * time.Second //振铃上报被其他指令读走时按时间估算响铃次数
+	VOICEMAIL_RING_TIMEOUT     time.Duration = 3 * time.Minute
+	VOICEMAIL_DOWNLOAD_TIMEOUT time.Duration = 2 * time.Minute
+)
+
+var qfdwlRgx = regexp.MustCompile(`\r\n\+QFDWL: (\d+),`)
+
+// 一次来电的结果, File为空表示没有留言
+type VoicemailRecord struct {
+	Caller   string
+	Time     time.Time
+	File     string
+	Duration time.Duration
+	Note     string //没有留言的原因或录音失败的错误
+}
+
+func (r VoicemailRecord) String() string {
+	caller := r.Caller
+	if len(caller) == 0 {
+		caller = "未知号码"
+	}
+	if len(r.File) == 0 {
+		msg := "未接来电: " + caller + " 时间: " + r.Time.Format("2006-01-02 15:04:05")
+		if len(r.Note) > 0 {
+			msg += "\n" + r.Note
+		}
+		return msg
+	}
+	return fmt.Sprintf("语音留言: %s 时间: %s 时长: %d秒", caller, r.Time.Format("2006-01-02 15:04:05"), int(r.Duration.Seconds()))
+}
+
+// 来电监听和语音信箱, voicemailrings为0时只通知未接来电
+type Voicemail struct {
+	modem *Modem
+	rings chan string
+}
+
+func NewVoicemail(modem *Modem) *Voicemail {
+	return &Voicemail{modem: modem, rings: make(chan string, 10)}
+}
+
+// 指令结果中有振铃或来电号码的上报时调用, 不会阻塞
+// 只认单独成行的RING、+CRING和+CLIP, USSD正文或下载的二进制文件中的RING不算来电
+func (v *Voicemail) Ring(result string) {
+	if _, ok := atparse.ParseCLIP(result); !ok && atparse.ParseRings(result) == 0 {
+		return
+	}
+	select {
+	case v.rings <- result:
+	default:
+	}
+}
+
+// 每次来电结束后调用done, 一次只处理一个来电
+func (v *Voicemail) Run(done func(record VoicemailRecord)) {
+	for {
+		result := <-v.rings
+		if record, ok := v.handle(result); ok {
+			done(record)
+		}
+		//通话期间的振铃上报已经处理过
+		for len(v.rings) > 0 {
+			<-v.rings
+		}
+	}
+}
+
+// 振铃上报是通话结束前的残留时ok为false
+func (v *Voicemail) handle(result string) (record VoicemailRecord, ok bool) {
+	modem, config := v.modem, v.modem.Config
+	record.Time = time.Now()
+	rings := 0
+	var greeting []byte
+	var greetingErr error
+	prepared := false
+	for {
+		for len(v.rings) > 0 {
+			result += <-v.rings
+		}
+		rings += atparse.ParseRings(result)
+		if id, ok := atparse.ParseCLIP(result); ok && len(id.Number) > 0 {
+			record.Caller = decodeCharset(id.Number)
+		}
+		if time.Since(record.Time) > VOICEMAIL_RING_TIMEOUT {
+			record.Note = "振铃超时"
+			return record, true
+		}
+		time.Sleep(CALL_POLL_INTERVAL)
+		//结果中的振铃上报会经过Ring再次送到rings, 这里不重复计数
+		clcc, err := modem.execCmd(CMD_CLCC)
+		result = ""
+		if err != nil {
+			continue
+		}
+		call, found := incomingCall(clcc)
+		if !found {
+			return record, rings > 0 || len(record.Caller) > 0
+		}
+		if len(record.Caller) == 0 && len(call.Number) > 0 {
+			record.Caller = decodeCharset(call.Number)
+		}
+		//有其他通话时不自动接听
+		if config.VoicemailRings <= 0 || config.Dialect == DIALECT_SIM900A || call.Stat != 4 {
+			continue
+		}
+		//pcm方式在振铃期间合成提示音, 避免接听后对方等待
+		if !prepared && config.SayMode == SAY_PCM {
+			greeting, greetingErr = synthesizePCM(config, voicemailGreeting(config))
+			prepared = true
+		}
+		elapsed := time.Since(record.Time)
+		if rings >= config.VoicemailRings || elapsed >= time.Duration(config.VoicemailRings)*VOICEMAIL_RING_PERIOD {
+			break
+		}
+	}
+
+	if greetingErr != nil {
+		record.Note = "提示音合成失败, 未接听: " + greetingErr.Error()
+		return record, true
+	}
+	if _, err := modem.execCmd(CMD_ATA); err != nil {
+		record.Note = "自动接听失败: " + err.Error()
+		return record, true
+	}
+	var alive bool
+	var err error
+	if config.SayMode == SAY_PCM {
+		alive, err = playPCM(modem, greeting)
+	} else {
+		alive, err = playTTS(modem, voicemailGreeting(config))
+	}
+	if err != nil {
+		modem.execCmd(CMD_ATH)
+		record.Note = "播放提示音失败, 已挂断: " + err.Error()
+		return record, true
+	}
+	if !alive {
+		record.Note = "对方在留言前挂断"
+		return record, true
+	}
+
+	var data []byte
+	var ext string
+	start := time.Now()
+	if config.VoicemailRecord == RECORD_PCM {
+		data, err = recordPCM(modem, voicemailDuration(config))
+		ext = AUDIO_WAV
+	} else {
+		data, err = recordQAUDRD(modem, voicemailDuration(config))
+		ext = AUDIO_AMR
+	}
+	record.Duration = time.Since(start)
+	if err != nil {
+		record.Note = "录音失败: " + err.Error()
+		return record, true
+	}
+	if record.File, err = saveVoicemail(config, record, data, ext); err != nil {
+		record.Note = "保存录音失败: " + err.Error()
+	}
+	return record, true
+}
+
+// 对方呼入的语音通话
+func incomingCall(result string) (atparse.Call, bool) {
+	for _, call := range atparse.ParseCLCC(result) {
+		if call.Dir == 1 && call.Mode == 0 {
+			return call, true
+		}
+	}
+	return atparse.Call{}, false
+}
+
+func voicemailGreeting(config Config) string {
+	if len(config.VoicemailGreeting) > 0 {
+		return config.VoicemailGreeting
+	}
+	return DEFAULT_VOICEMAIL_GREETING
+}
+
+func voicemailDuration(config Config) time.Duration {
+	seconds := config.VoicemailSeconds
+	if seconds == 0 {
+		seconds = DEFAULT_VOICEMAIL_SECONDS
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// 对方挂断或到达最长时间时结束录音并挂断
+func waitRecording(modem *Modem, max time.Duration) {
+	stop := make(chan struct{})
+	defer close(stop)
+	select {
+	case <-watchCall(modem, stop):
+	case <-time.After(max):
+		modem.execCmd(CMD_ATH)
+	}
+}
+
+// 录音保存在模块的RAM中, 结束后下载并删除
+func recordQAUDRD(modem *Modem, max time.Duration) ([]byte, error) {
+	file := strconv.Quote(VOICEMAIL_MODEM_FILE)
+	modem.execCmd(CMD_QFDEL + file)
+	if _, err := modem.execCmd(CMD_QAUDRD + "1," + file + ",3,1"); err != nil {
+		modem.execCmd(CMD_ATH)
+		return nil, err
+	}
+	waitRecording(modem, max)
+	modem.execCmd(CMD_QAUDRD + "0")
+	defer modem.execCmd(CMD_QFDEL + file)
+	result, err := modem.Exec(PhoneMsg{CmdDelay: 1, ATCmd: []byte(CMD_QFDWL + file + CMD_LF_CR)}, VOICEMAIL_DOWNLOAD_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return ParseQFDWL(result.Result)
+}
+
+// CONNECT\r\n<数据>\r\n+QFDWL: <长度>,<校验和>\r\n\r\nOK
+func ParseQFDWL(result string) ([]byte, error) {
+	if e := atparse.ParseError(result); e != nil && !strings.Contains(result, "CONNECT") {
+		return nil, errors.New(e.Error())
+	}
+	start := strings.Index(result, "CONNECT\r\n")
+	locs := qfdwlRgx.FindAllStringSubmatchIndex(result, -1)
+	if start < 0 || len(locs) == 0 {
+		return nil, errors.New("下载录音文件失败")
+	}
+	loc := locs[len(locs)-1]
+	start += len("CONNECT\r\n")
+	size, _ := strconv.Atoi(result[loc[2]:loc[3]])
+	if loc[0] < start || loc[0]-start != size {
+		return nil, fmt.Errorf("录音文件不完整: 收到%d字节, 应为%d字节", loc[0]-start, size)
+	}
+	return []byte(result[start:loc[0]]), nil
+}
+
+// 通过AT+QPCMV从USB口读取通话的PCM数据, 保存为WAV
+func recordPCM(modem *Modem, max time.Duration) ([]byte, error) {
+	device := modem.Config.SayAudioDevice
+	if len(device) == 0 {
+		modem.execCmd(CMD_ATH)
+		return nil, errors.New("voicemailrecord为pcm时需要配置sayaudiodevice")
+	}
+	if _, err := modem.execCmd(CMD_QPCMV + "1,0"); err != nil {
+		modem.execCmd(CMD_ATH)
+		return nil, err
+	}
+	defer modem.execCmd(CMD_QPCMV + "0")
+	port, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		modem.execCmd(CMD_ATH)
+		return nil, err
+	}
+	done := make(chan []byte)
+	go func() {
+		var pcm []byte
+		buf := make([]byte, PCM_FRAME*50)
+		for {
+			n, err := port.Read(buf)
+			pcm = append(pcm, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		done <- pcm
+	}()
+	waitRecording(modem, max)
+	port.Close()
+	pcm := <-done
+	if len(pcm) < 2 {
+		return nil, errors.New("没有读到语音数据")
+	}
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return encodeWAV(samples, PCM_RATE), nil
+}
+
+// 文件名为 [模块_]时间_号码.格式
+func saveVoicemail(config Config, record VoicemailRecord, data []byte, ext string) (string, error) {
+	dir := config.VoicemailDir
+	if len(dir) == 0 {
+		dir = DEFAULT_VOICEMAIL_DIR
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	caller := strings.Map(func(r rune) rune {
+		if r == '+' || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, record.Caller)
+	if len(caller) == 0 {
+		caller = "unknown"
+	}
+	name := record.Time.Format("20060102-150405") + "_" + caller + "." + ext
+	if len(config.Label) > 0 {
+		name = config.Label + "_" + name
+	}
+	path := filepath.Join(dir, name)
+	return path, ioutil.WriteFile(path, data, 0644)
+}